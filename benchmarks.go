@@ -0,0 +1,410 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Storage of benchmark results and comparison with earlier runs.
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"crypto/sha1"
+	"exec"
+	"io/ioutil"
+	"math"
+	path "path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// result of a single Benchmark* function
+type BenchmarkResult struct {
+	Name        string  // full name as printed by _testmain (package.BenchmarkXxx)
+	Iterations  int     // number of iterations
+	NsPerOp     float64 // nanoseconds per iteration
+	MBPerSec    float64 // throughput, 0 if the benchmark doesn't set bytes
+	BytesPerOp  float64 // allocated bytes per iteration
+	AllocsPerOp float64 // allocations per iteration
+	HasMemStats bool    // true = BytesPerOp/AllocsPerOp were printed
+}
+
+/*
+ Parses a line of benchmark output like
+ "pack.BenchmarkXxx   1000000   1234 ns/op   12.34 MB/s   16 B/op   1 allocs/op".
+ Returns nil if the line is no benchmark result.
+*/
+func parseBenchmarkLine(line string) *BenchmarkResult {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || strings.Index(fields[0], "Benchmark") < 0 {
+		return nil
+	}
+
+	result := &BenchmarkResult{Name: fields[0]}
+	var err os.Error
+	if result.Iterations, err = strconv.Atoi(fields[1]); err != nil {
+		return nil
+	}
+
+	var hasNsPerOp bool
+	for i := 2; i+1 < len(fields); i += 2 {
+		value, err := strconv.Atof64(fields[i])
+		if err != nil {
+			return nil
+		}
+		switch fields[i+1] {
+		case "ns/op":
+			result.NsPerOp = value
+			hasNsPerOp = true
+		case "MB/s":
+			result.MBPerSec = value
+		case "B/op":
+			result.BytesPerOp = value
+			result.HasMemStats = true
+		case "allocs/op":
+			result.AllocsPerOp = value
+			result.HasMemStats = true
+		}
+	}
+
+	if !hasNsPerOp {
+		return nil
+	}
+	return result
+}
+
+/*
+ Formats a result the same way as it is parsed by parseBenchmarkLine.
+*/
+func (this *BenchmarkResult) String() string {
+	str := fmt.Sprintf("%s\t%d\t%.2f ns/op", this.Name, this.Iterations, this.NsPerOp)
+	if this.MBPerSec != 0 {
+		str += fmt.Sprintf("\t%.2f MB/s", this.MBPerSec)
+	}
+	if this.HasMemStats {
+		str += fmt.Sprintf("\t%.0f B/op\t%.0f allocs/op", this.BytesPerOp, this.AllocsPerOp)
+	}
+	return str
+}
+
+// ========== history ==========
+
+/*
+ Returns the label a benchmark run is stored under: -bench-label, the current
+ git commit or "latest" if neither is available. Uncommitted changes get
+ their own label (see getGitCommit), so runs of different code never end up
+ under the same label.
+*/
+func getBenchmarkLabel() string {
+	label := *flagBenchLabel
+	if label == "" {
+		label = getGitCommit()
+	}
+	if label == "" {
+		label = "latest"
+	}
+	return toBenchmarkFileLabel(label)
+}
+
+/*
+ Returns a label as it's used in file names, with "/" and whitespace
+ replaced by "_".
+*/
+func toBenchmarkFileLabel(label string) string {
+	return strings.Map(func(rune int) int {
+		if rune == '/' || rune == ' ' || rune == '\t' {
+			return '_'
+		}
+		return rune
+	}, label)
+}
+
+/*
+ Returns the abbreviated hash of the current git commit, or "" if this
+ isn't a git repository. If the tree has uncommitted changes "-dirty-" and
+ the start of a hash of them is added.
+*/
+func getGitCommit() string {
+	output, ok := runGit("rev-parse", "--short", "HEAD")
+	if !ok {
+		return ""
+	}
+	commit := strings.TrimSpace(string(output))
+
+	diff, ok := runGit("diff", "HEAD")
+	if ok && len(diff) > 0 {
+		h := sha1.New()
+		h.Write(diff)
+		commit += fmt.Sprintf("-dirty-%x", h.Sum())[0:len("-dirty-")+7]
+	}
+	return commit
+}
+
+/*
+ Runs git in the root path and returns its output, ok is false if git
+ isn't installed or failed.
+*/
+func runGit(args ...string) (output []byte, ok bool) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		return nil, false
+	}
+
+	argv := append([]string{gitBin}, args...)
+	cmd, err := exec.Run(gitBin, argv, os.Environ(), rootPath,
+		exec.DevNull, exec.Pipe, exec.DevNull)
+	if err != nil {
+		return nil, false
+	}
+	output, _ = ioutil.ReadAll(cmd.Stdout)
+	waitmsg, err := cmd.Wait(0)
+	if err != nil || waitmsg.ExitStatus() != 0 {
+		return nil, false
+	}
+	return output, true
+}
+
+func getBenchmarkFilename(label string) string {
+	return path.Join(*flagBenchDir, label+".bench")
+}
+
+/*
+ Appends the results of this run to the history file of the label. Every run
+ adds one sample per benchmark.
+*/
+func saveBenchmarkResults(label string, results []*BenchmarkResult) {
+	if err := os.MkdirAll(*flagBenchDir, rootPathPerm); err != nil {
+		testLog.Error("Could not create %s: %s\n", *flagBenchDir, err)
+		return
+	}
+
+	filename := getBenchmarkFilename(label)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		testLog.Error("Could not save benchmark results: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	for _, result := range results {
+		file.WriteString(result.String() + "\n")
+	}
+	testLog.Info("Benchmark results saved as %s.\n", filename)
+}
+
+/*
+ Loads all samples stored for a label, grouped by benchmark name.
+*/
+func loadBenchmarkResults(label string) (samples map[string][]*BenchmarkResult, err os.Error) {
+	file, err := os.Open(getBenchmarkFilename(label))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return groupBenchmarkResults(readBenchmarkResults(bufio.NewReader(file))), nil
+}
+
+func readBenchmarkResults(reader *bufio.Reader) (results []*BenchmarkResult) {
+	for {
+		line, err := reader.ReadString('\n')
+		if result := parseBenchmarkLine(line); result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return
+}
+
+func groupBenchmarkResults(results []*BenchmarkResult) map[string][]*BenchmarkResult {
+	samples := make(map[string][]*BenchmarkResult)
+	for _, result := range results {
+		samples[result.Name] = append(samples[result.Name], result)
+	}
+	return samples
+}
+
+// ========== comparison ==========
+
+// mean and standard deviation of a set of samples
+type benchmarkStats struct {
+	n      int
+	mean   float64
+	stddev float64
+}
+
+func newBenchmarkStats(values []float64) (stats benchmarkStats) {
+	stats.n = len(values)
+	if stats.n == 0 {
+		return
+	}
+	for _, v := range values {
+		stats.mean += v
+	}
+	stats.mean /= float64(stats.n)
+	if stats.n > 1 {
+		for _, v := range values {
+			stats.stddev += (v - stats.mean) * (v - stats.mean)
+		}
+		stats.stddev = math.Sqrt(stats.stddev / float64(stats.n-1))
+	}
+	return
+}
+
+/*
+ Returns the stats of one value (selected by get) of all samples.
+*/
+func getBenchmarkStats(samples []*BenchmarkResult, get func(*BenchmarkResult) float64) benchmarkStats {
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = get(sample)
+	}
+	return newBenchmarkStats(values)
+}
+
+/*
+ Welch's t-test. Returns (significant, true) if the difference of the means
+ is significant (|t| > 2, about 95% confidence), or (false, false) if there
+ aren't enough samples to decide.
+*/
+func isSignificant(oldStats, newStats benchmarkStats) (significant bool, known bool) {
+	if oldStats.n < 2 || newStats.n < 2 {
+		return false, false
+	}
+	variance := oldStats.stddev*oldStats.stddev/float64(oldStats.n) +
+		newStats.stddev*newStats.stddev/float64(newStats.n)
+	if variance == 0 {
+		return oldStats.mean != newStats.mean, true
+	}
+	t := (newStats.mean - oldStats.mean) / math.Sqrt(variance)
+	return math.Fabs(t) > 2, true
+}
+
+func formatBenchmarkStats(stats benchmarkStats) string {
+	if stats.n < 2 || stats.mean == 0 {
+		return fmt.Sprintf("%.2f", stats.mean)
+	}
+	return fmt.Sprintf("%.2f ±%.0f%%", stats.mean, 100*stats.stddev/stats.mean)
+}
+
+/*
+ Prints the difference between the baseline and the current results and
+ returns the names of all benchmarks that got slower by more than
+ -bench-threshold percent. Only significant differences are counted as
+ regression, so both sides need at least two samples. Benchmarks above the
+ threshold with too few samples are returned as undecided.
+*/
+func compareBenchmarkResults(baseline, current map[string][]*BenchmarkResult) (regressions, undecided []string) {
+	var names []string
+	for name, _ := range current {
+		if _, exists := baseline[name]; exists {
+			names = append(names, name)
+		}
+	}
+	sort.SortStrings(names)
+
+	if len(names) == 0 {
+		testLog.Warn("No benchmarks in common with the baseline.\n")
+		return
+	}
+
+	nsPerOp := func(r *BenchmarkResult) float64 { return r.NsPerOp }
+	bytesPerOp := func(r *BenchmarkResult) float64 { return r.BytesPerOp }
+	allocsPerOp := func(r *BenchmarkResult) float64 { return r.AllocsPerOp }
+
+	testLog.Info("%-40s %20s %20s %10s\n", "benchmark", "old ns/op", "new ns/op", "delta")
+	for _, name := range names {
+		oldStats := getBenchmarkStats(baseline[name], nsPerOp)
+		newStats := getBenchmarkStats(current[name], nsPerOp)
+		if oldStats.mean == 0 {
+			testLog.Info("%-40s %20s %20s (no baseline time)\n", name, formatBenchmarkStats(oldStats),
+				formatBenchmarkStats(newStats))
+			continue
+		}
+		delta := 100 * (newStats.mean - oldStats.mean) / oldStats.mean
+
+		note := ""
+		significant, known := isSignificant(oldStats, newStats)
+		if known && !significant {
+			note = " (not significant)"
+		} else if !known {
+			note = " (too few samples)"
+		}
+
+		testLog.Info("%-40s %20s %20s %+9.2f%%%s\n", name, formatBenchmarkStats(oldStats),
+			formatBenchmarkStats(newStats), delta, note)
+
+		if baseline[name][0].HasMemStats && current[name][0].HasMemStats {
+			oldBytes := getBenchmarkStats(baseline[name], bytesPerOp)
+			newBytes := getBenchmarkStats(current[name], bytesPerOp)
+			oldAllocs := getBenchmarkStats(baseline[name], allocsPerOp)
+			newAllocs := getBenchmarkStats(current[name], allocsPerOp)
+			testLog.Info("%-40s %20.0f %20.0f B/op\n", "", oldBytes.mean, newBytes.mean)
+			testLog.Info("%-40s %20.0f %20.0f allocs/op\n", "", oldAllocs.mean, newAllocs.mean)
+		}
+
+		if *flagBenchThreshold > 0 && delta > *flagBenchThreshold {
+			if significant {
+				regressions = append(regressions, name)
+			} else if !known {
+				undecided = append(undecided, name)
+			}
+		}
+	}
+	return
+}
+
+/*
+ Saves the benchmark results of a test run and compares them with the
+ baseline given by -bench-compare. Returns false if there were regressions
+ above the threshold.
+*/
+func handleBenchmarkResults(results []*BenchmarkResult) bool {
+	if len(results) == 0 {
+		return true
+	}
+
+	label := getBenchmarkLabel()
+	saveBenchmarkResults(label, results)
+
+	if *flagBenchCompare == "" {
+		return true
+	}
+
+	baseline, err := loadBenchmarkResults(toBenchmarkFileLabel(*flagBenchCompare))
+	if err != nil {
+		testLog.Error("Could not load benchmark baseline %s: %s\n", *flagBenchCompare, err)
+		return false
+	}
+
+	// all runs saved under the current label (including this one), a
+	// single sample is too noisy to compare
+	current, err := loadBenchmarkResults(label)
+	if err != nil {
+		current = groupBenchmarkResults(results)
+	}
+
+	testLog.Info("\nComparing %s with %s:\n", label, *flagBenchCompare)
+	regressions, undecided := compareBenchmarkResults(baseline, current)
+	if len(undecided) > 0 {
+		testLog.Warn("%d benchmark(s) slower by more than %.1f%%, but there are too few samples to decide\n",
+			len(undecided), *flagBenchThreshold)
+		testLog.WarnContinue("if it's a regression (at least two runs under both labels are needed):\n")
+		for _, name := range undecided {
+			testLog.WarnContinue("%s\n", name)
+		}
+	}
+	if len(regressions) > 0 {
+		testLog.Error("%d benchmark(s) slower by more than %.1f%%:\n", len(regressions), *flagBenchThreshold)
+		for _, name := range regressions {
+			testLog.ErrorContinue("%s\n", name)
+		}
+		return false
+	}
+	return true
+}
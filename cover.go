@@ -0,0 +1,465 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Code coverage for test builds (-cover) and the reports created from the
+ coverage profile (-cover-report).
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"./godata"
+)
+
+// profile written by _testmain after the tests of a -cover build
+const coverProfile = "_test/cover.out"
+
+// file with the counter variables for each instrumented package
+var coverCounterFiles = make(map[string]string)
+
+// ========== instrumentation ==========
+
+/*
+ A block of statements without branches, all statements in it are executed
+ whenever the first one is (see getBlockLength). Written to the profile as
+ "file:startLine.startCol,endLine.endCol numStmt".
+*/
+type coverBlock struct {
+	filename           string
+	startLine, startCol int
+	endLine, endCol     int
+	numStmt             int
+}
+
+func (this *coverBlock) String() string {
+	return fmt.Sprintf("%s:%d.%d,%d.%d %d", this.filename,
+		this.startLine, this.startCol, this.endLine, this.endCol, this.numStmt)
+}
+
+// this visitor adds a counter to the beginning of every block of a
+// statement list
+type coverVisitor struct {
+	fset   *token.FileSet
+	blocks []*coverBlock
+	skip   map[*ast.BlockStmt]bool // bodies of switch/select, they only have clauses
+}
+
+/*
+ Implementation of the visitor interface for ast walker.
+*/
+func (v *coverVisitor) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		if !v.skip[n] {
+			n.List = v.addCounter(n.List)
+		}
+	case *ast.CaseClause:
+		n.Body = v.addCounter(n.Body)
+	case *ast.CommClause:
+		n.Body = v.addCounter(n.Body)
+	case *ast.SwitchStmt:
+		v.skip[n.Body] = true
+	case *ast.TypeSwitchStmt:
+		v.skip[n.Body] = true
+	case *ast.SelectStmt:
+		v.skip[n.Body] = true
+	}
+	return v
+}
+
+/*
+ Splits a list of statements into blocks and inserts a counter in front of
+ each of them (see addBlockCounter).
+*/
+func (v *coverVisitor) addCounter(list []ast.Stmt) []ast.Stmt {
+	var result []ast.Stmt
+	for len(list) > 0 {
+		n := getBlockLength(list)
+		result = append(result, v.addBlockCounter(list[0:n])...)
+		list = list[n:]
+	}
+	return result
+}
+
+/*
+ Returns the number of statements at the start of a list that form a block:
+ a block ends after a statement that branches or doesn't return (return,
+ break, panic, if, for, ...) and a labeled statement starts a new one, as
+ goto can jump there.
+*/
+func getBlockLength(list []ast.Stmt) int {
+	for i, stmt := range list {
+		if _, isLabeled := stmt.(*ast.LabeledStmt); isLabeled && i > 0 {
+			return i
+		}
+		if endsBlock(stmt) {
+			return i + 1
+		}
+	}
+	return len(list)
+}
+
+/*
+ Returns true if the statement after stmt isn't always executed when stmt
+ is.
+*/
+func endsBlock(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt, *ast.BranchStmt, *ast.BlockStmt, *ast.IfStmt, *ast.ForStmt,
+		*ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		return true
+	case *ast.LabeledStmt:
+		return endsBlock(s.Stmt)
+	case *ast.ExprStmt:
+		if call, isCall := s.X.(*ast.CallExpr); isCall {
+			if ident, isIdent := call.Fun.(*ast.Ident); isIdent && ident.Name == "panic" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ Inserts "GobuildCoverCounts[n]++" in front of a block of statements and
+ remembers the position of the statements as block n.
+*/
+func (v *coverVisitor) addBlockCounter(list []ast.Stmt) []ast.Stmt {
+	start := v.fset.Position(list[0].Pos())
+	end := v.fset.Position(list[len(list)-1].End())
+	block := &coverBlock{start.Filename, start.Line, start.Column,
+		end.Line, end.Column, len(list)}
+
+	counter := &ast.IncDecStmt{
+		X: &ast.IndexExpr{
+			X:     ast.NewIdent("GobuildCoverCounts"),
+			Index: &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(len(v.blocks))},
+		},
+		Tok: token.INC,
+	}
+	v.blocks = append(v.blocks, block)
+
+	if labeled, isLabeled := list[0].(*ast.LabeledStmt); isLabeled {
+		if result, ok := insertAfterLabel(labeled, counter, list); ok {
+			return result
+		}
+	}
+	return append([]ast.Stmt{counter}, list...)
+}
+
+/*
+ Puts the counter of a block that starts with a labeled statement after the
+ label, so that a goto to the label counts the block. Loops and switches
+ have to keep their label for break and continue, their counter becomes the
+ init statement if they have none. Returns false if that isn't possible
+ (range, select, an init statement), the counter goes in front of the label
+ then.
+*/
+func insertAfterLabel(labeled *ast.LabeledStmt, counter ast.Stmt, list []ast.Stmt) ([]ast.Stmt, bool) {
+	switch s := labeled.Stmt.(type) {
+	case *ast.ForStmt:
+		if s.Init == nil {
+			s.Init = counter
+			return list, true
+		}
+	case *ast.SwitchStmt:
+		if s.Init == nil {
+			s.Init = counter
+			return list, true
+		}
+	case *ast.TypeSwitchStmt:
+		if s.Init == nil {
+			s.Init = counter
+			return list, true
+		}
+	case *ast.RangeStmt, *ast.SelectStmt:
+	default:
+		// "L: stmt" becomes "L: counter; stmt"
+		stmt := labeled.Stmt
+		labeled.Stmt = counter
+		result := []ast.Stmt{labeled, stmt}
+		return append(result, list[1:]...), true
+	}
+	return list, false
+}
+
+/*
+ Instruments all non-test files of a package for -cover. The instrumented
+ copies are written into _test/cover/ and replace the original files when
+ compiling (see getCompileFiles). An additional file declares the counters.
+ Returns false if the package can't be instrumented or has no statements.
+*/
+func coverPackage(pack *godata.GoPackage) bool {
+	if counterFile, exists := coverCounterFiles[pack.Name]; exists {
+		return counterFile != ""
+	}
+	coverCounterFiles[pack.Name] = ""
+
+	if pack.Name == "main" || pack.HasCGOFiles() {
+		return false
+	}
+
+	visitor := &coverVisitor{fset: token.NewFileSet(), skip: make(map[*ast.BlockStmt]bool)}
+	var packDir string
+
+	for _, gf := range pack.GetSourceFiles(false) {
+		fileast, err := parser.ParseFile(visitor.fset, gf.Filename, nil, 0)
+		if err != nil {
+			testLog.Error("%s\n", err)
+			os.Exit(1)
+		}
+		ast.Walk(visitor, fileast)
+
+		var buf bytes.Buffer
+		if _, err = printer.Fprint(&buf, visitor.fset, fileast); err != nil {
+			testLog.Error("Could not instrument %s: %s\n", gf.Filename, err)
+			os.Exit(1)
+		}
+		coverFile := getObjDir() + "cover/" + gf.Filename
+		writeGeneratedFile(coverFile, buf.Bytes())
+		replacedFiles[gf.Filename] = coverFile
+
+		if idx := strings.LastIndex(gf.Filename, "/"); idx >= 0 {
+			packDir = gf.Filename[0 : idx+1]
+		}
+	}
+
+	if len(visitor.blocks) == 0 {
+		return false
+	}
+	testLog.Debug("Instrumented %d blocks in package %s.\n", len(visitor.blocks), pack.Name)
+
+	// the counters are exported so that _testmain can read them
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "package %s\n\n", getLocalPackageName(pack.Name))
+	fmt.Fprintf(&buf, "var GobuildCoverCounts = make([]uint32, %d)\n\n", len(visitor.blocks))
+	buf.WriteString("var GobuildCoverBlocks = []string{\n")
+	for _, block := range visitor.blocks {
+		fmt.Fprintf(&buf, "\t%s,\n", strconv.Quote(block.String()))
+	}
+	buf.WriteString("}\n")
+
+	counterFile := getObjDir() + "cover/" + packDir + "_gobuild_cover.go"
+	writeGeneratedFile(counterFile, buf.Bytes())
+	coverCounterFiles[pack.Name] = counterFile
+
+	return true
+}
+
+// ========== reports ==========
+
+// a block from the coverage profile and its counter
+type coverProfileBlock struct {
+	coverBlock
+	count int
+}
+
+// all blocks of a package from the coverage profile
+type coverProfilePackage struct {
+	name   string
+	blocks []*coverProfileBlock
+}
+
+/*
+ Returns the percentage of statements that were executed at least once.
+*/
+func (this *coverProfilePackage) percentage() float64 {
+	var total, covered int
+	for _, block := range this.blocks {
+		total += block.numStmt
+		if block.count > 0 {
+			covered += block.numStmt
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+/*
+ Reads the coverage profile written by _testmain. Packages are returned in
+ the order they appear in the profile.
+*/
+func readCoverProfile(filename string) (packs []*coverProfilePackage, err os.Error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var pack *coverProfilePackage
+	reader := bufio.NewReader(file)
+	for lineNr := 1; ; lineNr++ {
+		line, readErr := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			block, packName, ok := parseCoverProfileLine(line)
+			if !ok {
+				return nil, os.NewError(fmt.Sprintf("%s:%d: invalid line", filename, lineNr))
+			}
+			if pack == nil || pack.name != packName {
+				pack = &coverProfilePackage{name: packName}
+				packs = append(packs, pack)
+			}
+			pack.blocks = append(pack.blocks, block)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return packs, nil
+}
+
+/*
+ Parses "pack file:startLine.startCol,endLine.endCol numStmt count".
+*/
+func parseCoverProfileLine(line string) (block *coverProfileBlock, packName string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return
+	}
+	colon := strings.LastIndex(fields[1], ":")
+	if colon < 0 {
+		return
+	}
+
+	block = new(coverProfileBlock)
+	block.filename = fields[1][0:colon]
+	pos := strings.Map(func(rune int) int {
+		if rune == '.' || rune == ',' {
+			return ' '
+		}
+		return rune
+	}, fields[1][colon+1:])
+	n, err := fmt.Sscan(pos, &block.startLine, &block.startCol, &block.endLine, &block.endCol)
+	if n != 4 || err != nil {
+		return nil, "", false
+	}
+	if block.numStmt, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, "", false
+	}
+	if block.count, err = strconv.Atoi(fields[3]); err != nil {
+		return nil, "", false
+	}
+	return block, fields[0], true
+}
+
+/*
+ Prints the coverage of every package in the profile.
+*/
+func printCoverage(packs []*coverProfilePackage) {
+	for _, pack := range packs {
+		testLog.Info("coverage: %5.1f%% of statements in %s\n", pack.percentage(), pack.name)
+	}
+}
+
+/*
+ Implements -cover-report: prints the coverage per package and writes
+ cover.html with the annotated source of all instrumented files.
+*/
+func coverReport() {
+	packs, err := readCoverProfile(coverProfile)
+	if err != nil {
+		testLog.Error("Could not read coverage profile (run gobuild -t -cover -run first): %s\n", err)
+		os.Exit(1)
+	}
+	printCoverage(packs)
+
+	htmlFile := outputDirPrefix + "cover.html"
+	if err = ioutil.WriteFile(htmlFile, createCoverHTML(packs), 0644); err != nil {
+		testLog.Error("Could not write %s: %s\n", htmlFile, err)
+		os.Exit(1)
+	}
+	testLog.Info("Annotated source written to %s.\n", htmlFile)
+}
+
+/*
+ Creates a HTML page with the source of every file in the profile. Lines are
+ green if they were executed, red if they weren't and not colored if they
+ don't belong to a block (declarations, comments). For nested blocks the
+ innermost one decides.
+*/
+func createCoverHTML(packs []*coverProfilePackage) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("<html>\n<head>\n<title>gobuild coverage</title>\n" +
+		"<style>\n" +
+		"body { font-family: sans-serif; }\n" +
+		"pre { font-family: monospace; }\n" +
+		".cov { background-color: #c0ffc0; }\n" +
+		".uncov { background-color: #ffc0c0; }\n" +
+		"</style>\n</head>\n<body>\n")
+
+	buf.WriteString("<h1>Coverage</h1>\n<table>\n")
+	for _, pack := range packs {
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%.1f%%</td></tr>\n", xmlEscape(pack.name), pack.percentage())
+	}
+	buf.WriteString("</table>\n")
+
+	for _, pack := range packs {
+		// group the blocks by file
+		files := make(map[string][]*coverProfileBlock)
+		for _, block := range pack.blocks {
+			files[block.filename] = append(files[block.filename], block)
+		}
+		var filenames []string
+		for filename, _ := range files {
+			filenames = append(filenames, filename)
+		}
+		sort.SortStrings(filenames)
+
+		for _, filename := range filenames {
+			source, err := ioutil.ReadFile(filename)
+			if err != nil {
+				testLog.Warn("Could not read %s: %s\n", filename, err)
+				continue
+			}
+
+			fmt.Fprintf(&buf, "<h2>%s</h2>\n<pre>\n", xmlEscape(filename))
+			for i, line := range strings.Split(string(source), "\n", -1) {
+				class := ""
+				if block := innermostBlock(files[filename], i+1); block != nil {
+					if block.count > 0 {
+						class = " class=\"cov\""
+					} else {
+						class = " class=\"uncov\""
+					}
+				}
+				fmt.Fprintf(&buf, "<span%s>%5d  %s</span>\n", class, i+1, xmlEscape(line))
+			}
+			buf.WriteString("</pre>\n")
+		}
+	}
+
+	buf.WriteString("</body>\n</html>\n")
+	return buf.Bytes()
+}
+
+/*
+ Returns the block that contains the line and starts last, or nil if no
+ block contains it.
+*/
+func innermostBlock(blocks []*coverProfileBlock, line int) (innermost *coverProfileBlock) {
+	for _, block := range blocks {
+		if block.startLine <= line && line <= block.endLine {
+			if innermost == nil || block.startLine > innermost.startLine ||
+				(block.startLine == innermost.startLine && block.endLine < innermost.endLine) {
+				innermost = block
+			}
+		}
+	}
+	return
+}
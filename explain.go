@@ -0,0 +1,245 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Explaining the build: why a package is included (-why) and why a package
+ is rebuilt by an incremental build (-incremental, -explain).
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"crypto/sha1"
+	"flag"
+	"io/ioutil"
+	"json"
+	"strings"
+	"./godata"
+	"./logger"
+)
+
+// ========== -why ==========
+
+/*
+ Returns the packages a build starts from: the selected libraries with -lib,
+ the selected main files otherwise (all of them if none are given).
+*/
+func getRootPackages() (roots []*godata.GoPackage) {
+	if *flagLibrary {
+		names := flag.Args()
+		if len(names) == 0 {
+			names = goPackages.GetPackageNames()
+		}
+		for _, name := range names {
+			if pack, exists := goPackages.Get(name); exists && name != "main" {
+				roots = append(roots, pack)
+			}
+		}
+		return
+	}
+
+	if flag.NArg() == 0 {
+		return goPackages.GetMainPackages(!*flagSingleMainFile)
+	}
+	for _, filename := range flag.Args() {
+		if pack, exists := goPackages.GetMain(filename, !*flagSingleMainFile); exists {
+			roots = append(roots, pack)
+		}
+	}
+	return
+}
+
+/*
+ Returns the files of a package that import dep.
+*/
+func getImportingFiles(pack, dep *godata.GoPackage) (files []string) {
+	for _, igf := range *pack.Files {
+		gf := igf.(*godata.GoFile)
+		if gf.Imports == nil {
+			continue
+		}
+		for _, iimp := range *gf.Imports {
+			if iimp.(*godata.GoPackage) == dep {
+				files = append(files, gf.Filename)
+				break
+			}
+		}
+	}
+	return
+}
+
+/*
+ Prints the shortest import chain from one of the root packages (see
+ getRootPackages) to the package given with -why, with the files that
+ contain the imports. Returns false if no root package imports it.
+*/
+func printWhy() bool {
+	target, exists := goPackages.Get(*flagWhy)
+	if !exists {
+		logger.Error("Package %s not found.\n", *flagWhy)
+		return false
+	}
+
+	// breadth first from all roots, so the first chain found is the shortest
+	previous := make(map[*godata.GoPackage]*godata.GoPackage)
+	roots := getRootPackages()
+	queue := make([]*godata.GoPackage, len(roots))
+	copy(queue, roots)
+	for _, root := range roots {
+		previous[root] = nil
+	}
+	for len(queue) > 0 && !containsPackage(previous, target) {
+		pack := queue[0]
+		queue = queue[1:]
+		for _, dep := range goPackages.Dependencies(pack, false) {
+			if _, visited := previous[dep]; !visited {
+				previous[dep] = pack
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	if !containsPackage(previous, target) {
+		logger.Info("%s is not imported by the selected packages.\n", target.Name)
+		return false
+	}
+
+	var chain []*godata.GoPackage
+	for pack := target; pack != nil; pack = previous[pack] {
+		chain = append([]*godata.GoPackage{pack}, chain...)
+	}
+
+	root := chain[0]
+	if root.Name == "main" {
+		logger.Info("%s (%s)\n", root.Name, root.OutputFile)
+	} else {
+		logger.Info("%s\n", root.Name)
+	}
+	for i := 1; i < len(chain); i++ {
+		logger.Info("    imports %s (%s)\n", chain[i].Name,
+			strings.Join(getImportingFiles(chain[i-1], chain[i]), ", "))
+	}
+	return true
+}
+
+func containsPackage(m map[*godata.GoPackage]*godata.GoPackage, pack *godata.GoPackage) bool {
+	_, exists := m[pack]
+	return exists
+}
+
+// ========== incremental builds ==========
+
+// what a package was compiled from, stored next to its object file
+type buildState struct {
+	Flags   string            // compiler command line without the source files
+	Sources map[string]string // source file -> hash
+	Depends map[string]string // object file of a dependency -> hash
+}
+
+func getBuildStateFilename(pack *godata.GoPackage) string {
+	return getObjDir() + "_state/" + strings.Replace(pack.OutputFile, "/", "_", -1) + ".json"
+}
+
+/*
+ Returns the hash of a file's content, or "" if it can't be read.
+*/
+func getFileHash(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	h := sha1.New()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+/*
+ Returns the current build state of a package for the compiler command line
+ (argv without the source files). Source files are relative to the object
+ directory.
+*/
+func getBuildState(pack *godata.GoPackage, argv []string, sourceFiles []string) *buildState {
+	state := &buildState{getCommandline(argv), make(map[string]string), make(map[string]string)}
+	for _, filename := range sourceFiles {
+		state.Sources[filename] = getFileHash(toRootPath(filename))
+	}
+	for _, idep := range *pack.Depends {
+		dep := idep.(*godata.GoPackage)
+		if dep.Compiled {
+			objFile := getObjDir() + dep.OutputFile + objExt
+			state.Depends[objFile] = getFileHash(objFile)
+		}
+	}
+	return state
+}
+
+/*
+ Returns why a package has to be compiled again, or "" if it's up to date:
+ a missing output, changed flags, a changed source file or a rebuilt
+ dependency.
+*/
+func getRebuildReason(pack *godata.GoPackage, state *buildState) string {
+	if _, err := os.Stat(getObjDir() + pack.OutputFile + objExt); err != nil {
+		return "missing output " + getObjDir() + pack.OutputFile + objExt
+	}
+
+	data, err := ioutil.ReadFile(getBuildStateFilename(pack))
+	if err != nil {
+		return "no previous build"
+	}
+	old := new(buildState)
+	if err = json.Unmarshal(data, old); err != nil {
+		return "invalid build state " + getBuildStateFilename(pack)
+	}
+
+	if old.Flags != state.Flags {
+		return "changed flags"
+	}
+	for _, filename := range getSortedKeys(keysOf(state.Sources)) {
+		if oldHash, exists := old.Sources[filename]; !exists {
+			return "new source file " + toRootPath(filename)
+		} else if oldHash != state.Sources[filename] {
+			return "changed source file " + toRootPath(filename)
+		}
+	}
+	for _, filename := range getSortedKeys(keysOf(old.Sources)) {
+		if _, exists := state.Sources[filename]; !exists {
+			return "removed source file " + toRootPath(filename)
+		}
+	}
+	for _, objFile := range getSortedKeys(keysOf(state.Depends)) {
+		if old.Depends[objFile] != state.Depends[objFile] {
+			return "rebuilt dependency " + objFile
+		}
+	}
+	return ""
+}
+
+func keysOf(m map[string]string) map[string]bool {
+	keys := make(map[string]bool)
+	for key, _ := range m {
+		keys[key] = true
+	}
+	return keys
+}
+
+/*
+ Stores the build state of a package after compiling it.
+*/
+func saveBuildState(pack *godata.GoPackage, state *buildState) {
+	if *flagDryRun {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		filename := getBuildStateFilename(pack)
+		if err = os.MkdirAll(filename[0:strings.LastIndex(filename, "/")], rootPathPerm); err == nil {
+			err = ioutil.WriteFile(filename, data, 0644)
+		}
+	}
+	if err != nil {
+		compileLog.Warn("Could not save the build state of %s: %s\n", pack.Name, err)
+	}
+}
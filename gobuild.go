@@ -7,15 +7,18 @@
 */
 package main
 
-// import "fmt"
-
 import (
 	"os"
+	"fmt"
 	"runtime"
 	"exec"
 	"flag"
+	"io"
+	"io/ioutil"
 	path "path/filepath"
 	"strings"
+	"sort"
+	"strconv"
 	"container/vector"
 	"./godata"
 	"./logger"
@@ -39,6 +42,39 @@ var flagMatch *string = flag.String("match", "", "regular expression to select t
 var flagBenchmarks *string = flag.String("benchmarks", "", "regular expression to select benchmarks to run")
 var flagIgnore *string = flag.String("ignore", "", "ignore these files")
 var flagKeepAFiles *bool = flag.Bool("keep-a-files", false, "don't automatically delete .a archive files")
+var flagJUnitReport *string = flag.String("junit", "", "write a JUnit XML report of the test run to this file")
+var flagJSONReport *string = flag.String("json", "", "write a JSON report of the test run to this file")
+var flagTimeout *string = flag.String("timeout", "", "kill the test executable if all tests take longer (e.g. 10m)")
+var flagPackageTimeout *string = flag.String("package-timeout", "", "kill the test executable if a package takes longer (e.g. 30s)")
+var flagShard *string = flag.String("shard", "", "only build the tests of shard i of n (i/n)")
+var flagShardDurations *string = flag.String("shard-durations", "", "JSON test report (-json) used to balance the shards")
+var flagRetry *int = flag.Int("retry", 0, "run failed tests again up to this many times")
+var flagFlakyReport *string = flag.String("flaky-report", "", "write the tests that passed on a retry to this file")
+var flagNoTestCache *bool = flag.Bool("no-test-cache", false, "run all tests, even those with a cached result")
+var flagFuzz *string = flag.String("fuzz", "", "fuzz the Fuzz* function matching this regular expression")
+var flagFuzzTime *string = flag.String("fuzztime", "30s", "time to spend with -fuzz")
+var flagTestEvents *string = flag.String("test-events", "", "write the events of the test run as JSON lines to this file (- for stdout)")
+var flagCover *bool = flag.Bool("cover", false, "instrument packages under test for a coverage profile")
+var flagBenchDir *string = flag.String("bench-dir", "_bench", "directory for the history of benchmark results")
+var flagBenchLabel *string = flag.String("bench-label", "", "save benchmark results under this label (default: git commit)")
+var flagBenchCompare *string = flag.String("bench-compare", "", "compare benchmark results with this label")
+var flagBenchThreshold *float64 = flag.Float64("bench-threshold", 0, "fail if a benchmark is slower than the baseline by more percent")
+var flagMutate *string = flag.String("mutate", "", "run the tests of this package against mutations of its source")
+var flagChanged *bool = flag.Bool("changed", false, "only test packages affected by the files given as arguments")
+var flagSince *string = flag.String("since", "", "only test packages affected by the files changed since this git revision")
+var flagLogFile *string = flag.String("log-file", "", "also write all messages to this file")
+var flagLogFormat *string = flag.String("log-format", "text", "format of the log file (or stdout without -log-file): text or json")
+var flagLogLevels *string = flag.String("log-levels", "", "levels of single components, e.g. compile=warn,test=debug")
+var flagOutput *string = flag.String("output", "plain", "output of compiler and tests: plain, prefix (with package) or block (per package)")
+var flagCoverReport *bool = flag.Bool("cover-report", false, "print coverage of the last -cover run and create cover.html")
+var flagDryRun *bool = flag.Bool("n", false, "print the commands that would be run but don't run them")
+var flagPrintCommands *bool = flag.Bool("x", false, "print the commands while running them")
+var flagWhy *string = flag.String("why", "", "print the shortest import chain to this package")
+var flagIncremental *bool = flag.Bool("incremental", false, "only compile packages whose sources, flags or dependencies changed")
+var flagExplain *bool = flag.Bool("explain", false, "print why a package is compiled again (with -incremental)")
+var flagNoScanCache *bool = flag.Bool("no-scan-cache", false, "parse all files instead of reusing the results of the last run")
+var flagJobs *int = flag.Int("j", 0, "number of files parsed at the same time (default: number of CPUs)")
+var flagQuery *string = flag.String("query", "", "print the packages or files matching a query like deps(x) - stdlib")
 // ========== global (package) variables ==========
 
 var compilerBin string
@@ -51,9 +87,27 @@ var rootPathPerm uint32
 var objExt string
 var outputDirPrefix string
 var goPackages *godata.GoPackageContainer
+var scanCache *godata.ScanCache // nil with -no-scan-cache
+
+// parse results of the last run (see godata.ScanCache)
+const SCAN_CACHE_FILE = "_state/scan.json"
+
+// loggers of the components, see -log-levels
+var scanLog = logger.Get("scan")
+var compileLog = logger.Get("compile")
+var linkLog = logger.Get("link")
+var testLog = logger.Get("test")
+var quietBuild bool = false // true = don't show compiler/linker output
+
+// copies of source files that are compiled instead of the originals
+// (original name -> copy), used by -cover and -mutate
+var replacedFiles = make(map[string]string)
 
 // ========== goFileVisitor ==========
 
+// the files found by readFiles, in the order of the directory walk
+var scanFiles []*godata.GoFile
+
 // this visitor looks for files with the extension .go
 type goFileVisitor struct {
 	rootpath string
@@ -85,7 +139,7 @@ func (v *goFileVisitor) VisitFile(filepath string, d *os.FileInfo) {
 			readFiles(filepath)
 		}
 	} else {
-		logger.Warn("%s\n", err)
+		scanLog.Warn("%s\n", err)
 	}
 
 	// run .y files through goyacc first to create .go files
@@ -107,50 +161,196 @@ func (v *goFileVisitor) VisitFile(filepath string, d *os.FileInfo) {
 		var gf godata.GoFile
 		if v.realpath != v.rootpath {
 			gf = godata.GoFile{v.symname + filepath[strings.LastIndex(filepath, "/"):],
-				nil, false, false, strings.HasSuffix(filepath, "_test.go"), nil, nil,
+				nil, false, false, strings.HasSuffix(filepath, "_test.go"), nil, nil, nil, nil, nil,
 			}
 		} else {
 			gf = godata.GoFile{filepath[len(v.realpath)+1 : len(filepath)], nil,
-				false, false, strings.HasSuffix(filepath, "_test.go"), nil, nil,
+				false, false, strings.HasSuffix(filepath, "_test.go"), nil, nil, nil, nil, nil,
 			}
 		}
 
 		if gf.IsTestFile {
 			gf.TestFunctions = new(vector.Vector)
 			gf.BenchmarkFunctions = new(vector.Vector)
+			gf.ExampleFunctions = new(vector.Vector)
+			gf.FuzzFunctions = new(vector.Vector)
 		}
-		logger.Debug("Parsing file: %s\n", filepath)
-
-		gf.ParseFile(goPackages)
+		// parsed later by parseFiles, all at once
+		scanFiles = append(scanFiles, &gf)
 	}
 }
 
 // ========== (local) functions ==========
 
-// unused right now, may be used later for a target directory for .[568] files
+/*
+ Returns the directory (relative to the root path) for .[568] files. Test
+ builds use their own directory so that objects compiled with _test.go files
+ never end up in a library or executable build and the other way around.
+ The compiler and linker are run inside this directory, which makes
+ 'import "./blub"' style imports work without further changes.
+*/
 func getObjDir() string {
+	if *flagTesting {
+		return "_test/"
+	}
 	return ""
+}
+
+/*
+ Converts a path relative to the root path into one that is relative to the
+ object directory (see getObjDir). Absolute paths are returned unchanged.
+*/
+func fromObjDir(filepath string) string {
+	if getObjDir() == "" || path.IsAbs(filepath) {
+		return filepath
+	}
+	return path.Join("..", filepath)
+}
 
-	// this doesn't work for 'import "./blub"' style imports
-	/*
-		if *flagTesting {
-			return "_test/";
+/*
+ Returns true if the compiler and linker have to search the root path for
+ a package: the .a files of cgo packages are built by hand in the root
+ path, while the compiler and linker run in the object directory (see
+ HasExistingAFile).
+*/
+func needsRootSearchPath(pack *godata.GoPackage) bool {
+	if getObjDir() == "" {
+		return false
+	}
+	for _, dep := range goPackages.Dependencies(pack, true) {
+		if dep.HasCGOFiles() {
+			return true
 		}
-		return "_obj/";*/
+	}
+	return false
+}
+
+/*
+ Converts a path relative to the object directory back into one that is
+ relative to the root path (reverses fromObjDir).
+*/
+func toRootPath(filepath string) string {
+	if getObjDir() == "" || path.IsAbs(filepath) {
+		return filepath
+	}
+	return path.Join(getObjDir(), filepath)
 }
 
 
 /*
  Returns an argv array in a single string with spaces dividing the entries.
+ Entries are quoted for the shell if needed.
 */
 func getCommandline(argv []string) string {
 	var str string
 	for _, s := range argv {
-		str += s + " "
+		str += quoteShellArg(s) + " "
 	}
 	return str[0 : len(str)-1]
 }
 
+/*
+ Puts a string in single quotes unless it only contains characters that
+ have no special meaning for the shell.
+*/
+func quoteShellArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	for _, rune := range arg {
+		if !(rune >= 'a' && rune <= 'z' || rune >= 'A' && rune <= 'Z' ||
+			rune >= '0' && rune <= '9' || strings.IndexRune("-_./=:,+@%", rune) >= 0) {
+			return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return arg
+}
+
+/*
+ Prints a command for -n and -x. Commands that don't run in the root path
+ are prefixed with a cd in a subshell.
+*/
+func printCommand(argv []string, dir string) {
+	if !*flagDryRun && !*flagPrintCommands {
+		return
+	}
+	if dir != rootPath && strings.HasPrefix(dir, rootPath+"/") {
+		logger.Print("(cd %s && %s)\n", quoteShellArg(dir[len(rootPath)+1:]), getCommandline(argv))
+	} else if dir != rootPath {
+		logger.Print("(cd %s && %s)\n", quoteShellArg(dir), getCommandline(argv))
+	} else {
+		logger.Print("%s\n", getCommandline(argv))
+	}
+}
+
+/*
+ Removes a file, ignoring errors. -n and -x print it as rm -f.
+*/
+func removeFile(filename string) os.Error {
+	printCommand([]string{"rm", "-f", filename}, rootPath)
+	if *flagDryRun {
+		return nil
+	}
+	return os.Remove(filename)
+}
+
+/*
+ Creates a directory and its parents. -n and -x print it as mkdir -p.
+*/
+func makeDirectory(dir string) os.Error {
+	printCommand([]string{"mkdir", "-p", dir}, rootPath)
+	if *flagDryRun {
+		return nil
+	}
+	return os.MkdirAll(dir, rootPathPerm)
+}
+
+/*
+ Writes a file that gobuild generates (like _testmain.go), including its
+ directory. -n and -x print it as a here document.
+*/
+func writeGeneratedFile(filename string, data []byte) {
+	if *flagDryRun || *flagPrintCommands {
+		logger.Print("cat > %s << 'EOF'\n%sEOF\n", quoteShellArg(filename), data)
+	}
+	if *flagDryRun {
+		return
+	}
+
+	if idx := strings.LastIndex(filename, "/"); idx >= 0 {
+		if err := os.MkdirAll(filename[0:idx], rootPathPerm); err != nil {
+			logger.Error("Could not create directory for %s: %s\n", filename, err)
+			os.Exit(1)
+		}
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		logger.Error("Could not write %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+}
+
+/*
+ Returns the package name without path/parent directories, which is the
+ name the package is referenced by after importing it.
+*/
+func getLocalPackageName(packName string) string {
+	if strings.LastIndex(packName, "/") >= 0 {
+		return packName[strings.LastIndex(packName, "/")+1:]
+	}
+	return packName
+}
+
+/*
+ Returns the keys of a map in sorted order.
+*/
+func getSortedKeys(m map[string]bool) (keys []string) {
+	for key, _ := range m {
+		keys = append(keys, key)
+	}
+	sort.SortStrings(keys)
+	return
+}
+
 /*
  readFiles reads all files with the .go extension and creates their AST.
  It also creates a list of local imports (everything starting with ./)
@@ -173,7 +373,7 @@ func readFiles(rootpath string) {
 			realpath = rootpath
 		}
 	} else {
-		logger.Warn("%s\n", err)
+		scanLog.Warn("%s\n", err)
 	}
 
 	// visitor for the path walker
@@ -183,24 +383,90 @@ func readFiles(rootpath string) {
 
 	select {
 	case err := <-errorChannel:
-		logger.Error("Error while traversing directories: %s\n", err)
+		scanLog.Error("Error while traversing directories: %s\n", err)
 	default:
 	}
 }
 
+/*
+ Parses all files found by readFiles with -j workers at the same time (the
+ number of CPUs by default) and adds them to goPackages.
+*/
+func parseFiles() {
+	workers := *flagJobs
+	if workers <= 0 {
+		workers = getCPUCount()
+	}
+	// the workers only run in parallel on more than one thread
+	if workers > runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(workers)
+	}
+
+	scanLog.Debug("Parsing %d file(s) with %d worker(s).\n", len(scanFiles), workers)
+	godata.ParseFiles(scanFiles, goPackages, scanCache, workers)
+}
+
+/*
+ Returns the number of CPUs (from /proc/cpuinfo), 1 if it's unknown.
+*/
+func getCPUCount() int {
+	data, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return 1
+	}
+	var count int
+	for _, line := range strings.Split(string(data), "\n", -1) {
+		if strings.HasPrefix(line, "processor") {
+			count++
+		}
+	}
+	return max(count, 1)
+}
+
+/*
+ Returns the packages with _test.go files that are tested together with a
+ package: the package itself (if it has _test.go files) and its external
+ test package (if there is one).
+*/
+func getTestFilePackages(pack *godata.GoPackage) (testFilePacks []*godata.GoPackage) {
+	if pack.HasTestFiles() {
+		testFilePacks = append(testFilePacks, pack)
+	}
+	if extPack, exists := goPackages.GetExternalTestPackage(pack.Name); exists {
+		testFilePacks = append(testFilePacks, extPack)
+	}
+	return
+}
+
+/*
+ Returns the directory with the corpus of a fuzz function:
+ testdata/fuzz/<name> in the directory of its file.
+*/
+func getFuzzCorpusDir(gf *godata.GoFile, name string) string {
+	dir, _ := path.Split(gf.Filename)
+	return path.Join(dir, "testdata", "fuzz", name)
+}
+
 /*
  Creates a main package and _testmain.go file for building a test application.
+ If filter is not nil, only the tests of the packages in it are added.
 */
-func createTestPackage() *godata.GoPackage {
+func createTestPackage(filter map[*godata.GoPackage]bool) *godata.GoPackage {
 	var testFileSource string
 	var testArrays string
 	var testCalls string
 	var benchCalls string
+	var coverEntries string
+	var fuzzTargets string
+	var packImports string
 	var testGoFile *godata.GoFile
 	var testPack *godata.GoPackage
-	var testFile *os.File
-	var err os.Error
 	var pack *godata.GoPackage
+	var testedPacks []*godata.GoPackage
+	var usedPacks = make(map[*godata.GoPackage]bool)
+	var stdImports = make(map[string]bool)
+	var usesRegexp bool // testing.Main, examples and fuzzing match names
+	var usesExamples bool
 
 	testGoFile = new(godata.GoFile)
 	testPack = godata.NewGoPackage("main")
@@ -213,34 +479,89 @@ func createTestPackage() *godata.GoPackage {
 	testPack.OutputFile = "_testmain"
 	testPack.Files.Push(testGoFile)
 
-	// search for packages with _test.go files
+	// search for packages with _test.go files, external test packages
+	// (package foo_test) are tested together with the package they belong to
 	for _, packName := range goPackages.GetPackageNames() {
 		pack, _ = goPackages.Get(packName)
 
+		if filter != nil && !filter[pack] {
+			continue
+		}
+
+		if pack.IsExternalTestPackage() {
+			basePack, exists := goPackages.Get(packName[0 : len(packName)-len(godata.EXTERNAL_TEST_SUFFIX)])
+			if exists && basePack.Files.Len() > 0 {
+				continue
+			}
+			testLog.Warn("No package found for external test package %s.\n", packName)
+		}
+
+		extPack, hasExtPack := goPackages.GetExternalTestPackage(packName)
 		if pack.HasTestFiles() {
 			testPack.Depends.Push(pack)
 		}
+		if hasExtPack {
+			testPack.Depends.Push(extPack)
+		}
+		if pack.HasTestFiles() || hasExtPack {
+			testedPacks = append(testedPacks, pack)
+			testedPackages = append(testedPackages, pack)
+		}
 	}
 
+	if testPack.Depends.Len() == 0 && filter != nil {
+		testLog.Info("No _test.go files found in the selected packages.\n")
+		os.Exit(0)
+	}
 	if testPack.Depends.Len() == 0 {
-		logger.Error("No _test.go files found.\n")
+		testLog.Error("No _test.go files found.\n")
 		os.Exit(1)
 	}
 
-	// imports
-	testFileSource =
-		"package main\n" +
-			"\nimport \"testing\"\n" +
-			"import __regexp__ \"regexp\"\n" +
-			"import \"fmt\"\n"
+	// with -shard only the tests, examples and benchmarks of this shard are
+	// added to _testmain
+	var shardTests map[string]bool
+	if *flagShard != "" {
+		var testNames []string
+		for _, pack := range testedPacks {
+			for _, tpack := range getTestFilePackages(pack) {
+				for _, igf := range *tpack.Files {
+					if (igf.(*godata.GoFile)).IsTestFile {
+						for _, istr := range *(igf.(*godata.GoFile)).TestFunctions {
+							testNames = append(testNames, tpack.Name+"."+istr.(string))
+						}
+						for _, istr := range *(igf.(*godata.GoFile)).FuzzFunctions {
+							testNames = append(testNames, tpack.Name+"."+istr.(string))
+						}
+						for _, iex := range *(igf.(*godata.GoFile)).ExampleFunctions {
+							if iex.(*godata.Example).HasOutput {
+								testNames = append(testNames, tpack.Name+"."+iex.(*godata.Example).Name)
+							}
+						}
+						// benchmarks only take time with -benchmarks
+						for _, istr := range *(igf.(*godata.GoFile)).BenchmarkFunctions {
+							if *flagBenchmarks != "" {
+								testNames = append(testNames, tpack.Name+"."+istr.(string))
+							}
+						}
+					}
+				}
+			}
+		}
+		shardTests = selectShardTests(testNames)
+		testLog.Info("Shard %s: %d of %d tests.\n", *flagShard, len(shardTests), len(testNames))
+	}
+	inShard := func(name string) bool {
+		return shardTests == nil || shardTests[name]
+	}
 
-	// will create an array per package with all the Test* and Benchmark* functions
-	// tests/benchmarks will be done for each package seperatly so that running
-	// the _testmain program will result in multiple PASS (or fail) outputs.
-	for _, ipack := range *testPack.Depends {
+	// will create an array per package with all the Test*, Example* and Benchmark*
+	// functions. tests/benchmarks will be done for each package seperatly so that
+	// running the _testmain program will result in multiple PASS (or fail) outputs.
+	for _, pack := range testedPacks {
 		var tmpStr string
 		var fnCount int = 0
-		pack := (ipack.(*godata.GoPackage))
+		var packCalls string
 
 		// localPackVarName: contains the test functions, package name
 		// with '/' replaced by '_'
@@ -250,52 +571,141 @@ func createTestPackage() *godata.GoPackage {
 			}
 			return rune
 		},pack.Name)
-		// localPackName: package name without path/parent directories
-		var localPackName string
-		if strings.LastIndex(pack.Name, "/") >= 0 {
-			localPackName = pack.Name[strings.LastIndex(pack.Name, "/")+1:]
-		} else {
-			localPackName = pack.Name
-		}
 
-		testFileSource += "import \"" + pack.Name + "\"\n"
+		testFilePacks := getTestFilePackages(pack)
 
 		tmpStr = "var test_" + localPackVarName + " = []testing.InternalTest {\n"
 
-		for _, igf := range *pack.Files {
-			logger.Debug("Test* from %s: \n", (igf.(*godata.GoFile)).Filename)
-			if (igf.(*godata.GoFile)).IsTestFile {
-				for _, istr := range *(igf.(*godata.GoFile)).TestFunctions {
-					tmpStr += "\ttesting.InternalTest{ \"" +
-						pack.Name + "." + istr.(string) +
-						"\", " +
-						localPackName + "." + istr.(string) +
-						" },\n"
-					fnCount++
+		for _, tpack := range testFilePacks {
+			localPackName := getLocalPackageName(tpack.Name)
+			for _, igf := range *tpack.Files {
+				testLog.Debug("Test* from %s: \n", (igf.(*godata.GoFile)).Filename)
+				if (igf.(*godata.GoFile)).IsTestFile {
+					for _, istr := range *(igf.(*godata.GoFile)).TestFunctions {
+						if !inShard(tpack.Name + "." + istr.(string)) {
+							continue
+						}
+						testFunctionNames = append(testFunctionNames, tpack.Name+"."+istr.(string))
+						tmpStr += "\ttesting.InternalTest{ \"" +
+							tpack.Name + "." + istr.(string) +
+							"\", " +
+							localPackName + "." + istr.(string) +
+							" },\n"
+						fnCount++
+						usedPacks[tpack] = true
+					}
+
+					// the corpus of a fuzz function is run as a regular test
+					for _, istr := range *(igf.(*godata.GoFile)).FuzzFunctions {
+						if !inShard(tpack.Name + "." + istr.(string)) {
+							continue
+						}
+						corpusDir := strconv.Quote(getFuzzCorpusDir(igf.(*godata.GoFile), istr.(string)))
+						testFunctionNames = append(testFunctionNames, tpack.Name+"."+istr.(string))
+						tmpStr += "\ttesting.InternalTest{ \"" +
+							tpack.Name + "." + istr.(string) +
+							"\", func(t *testing.T) { __runFuzzCorpus__(t, " + corpusDir + ", " +
+							localPackName + "." + istr.(string) +
+							") } },\n"
+						fuzzTargets += "\t__fuzzTarget__{ \"" +
+							tpack.Name + "." + istr.(string) +
+							"\", " +
+							localPackName + "." + istr.(string) +
+							", " + corpusDir +
+							" },\n"
+						fnCount++
+						usedPacks[tpack] = true
+					}
 				}
 			}
 		}
 		tmpStr += "}\n\n"
 
+		var testCount int = fnCount
+		var testMainCall string
 		if fnCount > 0 {
-			testCalls +=
-				"\tfmt.Println(\"Testing " + pack.Name + ":\");\n" +
-					"\ttesting.Main(__regexp__.MatchString, test_" + localPackVarName + ");\n"
+			// with -cover the profile is written before testing.Main exits
+			// on failures (see coverWriterSource)
+			matchFunc := "__regexp__.MatchString"
+			if *flagCover {
+				matchFunc = "__coverMatch__"
+				tmpStr = tmpStr[0:len(tmpStr)-len("}\n\n")] +
+					"\ttesting.InternalTest{ __coverLastTest__, func(t *testing.T) {} },\n}\n\n"
+			}
+			testMainCall = "\t\ttesting.Main(" + matchFunc + ", test_" + localPackVarName + ");\n"
 			testArrays += tmpStr
+			stdImports["testing"] = true
+			stdImports["fmt"] = true
+			usesRegexp = true
+		}
 
+		// examples without an output comment are only compiled
+		fnCount = 0
+		tmpStr = "var example_" + localPackVarName + " = []__example__ {\n"
+		for _, tpack := range testFilePacks {
+			localPackName := getLocalPackageName(tpack.Name)
+			for _, igf := range *tpack.Files {
+				if (igf.(*godata.GoFile)).IsTestFile {
+					for _, iex := range *(igf.(*godata.GoFile)).ExampleFunctions {
+						example := iex.(*godata.Example)
+						if !example.HasOutput || !inShard(tpack.Name+"."+example.Name) {
+							continue
+						}
+						testFunctionNames = append(testFunctionNames, tpack.Name+"."+example.Name)
+						tmpStr += "\t__example__{ \"" +
+							tpack.Name + "." + example.Name +
+							"\", " +
+							localPackName + "." + example.Name +
+							", " + strconv.Quote(example.Output) +
+							" },\n"
+						fnCount++
+						usedPacks[tpack] = true
+					}
+				}
+			}
+		}
+		tmpStr += "}\n\n"
+
+		// the examples run before the tests: testing.Main prints PASS,
+		// which ends the package for the report parsers
+		if fnCount > 0 {
+			packCalls += "\t\t__runExamples__(example_" + localPackVarName + ", " +
+				fmt.Sprint(testCount == 0) + ");\n"
+			testArrays += tmpStr
+			for _, imp := range exampleRunnerImports {
+				stdImports[imp] = true
+			}
+			usesRegexp = true
+			usesExamples = true
+		}
+		packCalls += testMainCall
+		if packCalls != "" {
+			packCalls = "\t\tfmt.Println(\"Testing " + pack.Name + ":\");\n" + packCalls
+		}
+
+		// packages with a cached result are skipped (see testcache.go)
+		if packCalls != "" {
+			testCalls += "\tif !__skip__(\"" + pack.Name + "\") {\n" + packCalls + "\t}\n"
 		}
 
 		fnCount = 0
 		tmpStr = "var bench_" + localPackVarName + " = []testing.Benchmark {\n"
-		for _, igf := range *pack.Files {
-			if (igf.(*godata.GoFile)).IsTestFile {
-				for _, istr := range *(igf.(*godata.GoFile)).BenchmarkFunctions {
-					tmpStr += "\ttesting.Benchmark{ \"" +
-						pack.Name + "." + istr.(string) +
-						"\", " +
-						localPackName + "." + istr.(string) +
-						" },\n"
-					fnCount++
+		for _, tpack := range testFilePacks {
+			localPackName := getLocalPackageName(tpack.Name)
+			for _, igf := range *tpack.Files {
+				if (igf.(*godata.GoFile)).IsTestFile {
+					for _, istr := range *(igf.(*godata.GoFile)).BenchmarkFunctions {
+						if *flagBenchmarks != "" && !inShard(tpack.Name+"."+istr.(string)) {
+							continue
+						}
+						tmpStr += "\ttesting.Benchmark{ \"" +
+							tpack.Name + "." + istr.(string) +
+							"\", " +
+							localPackName + "." + istr.(string) +
+							" },\n"
+						fnCount++
+						usedPacks[tpack] = true
+					}
 				}
 			}
 		}
@@ -306,7 +716,93 @@ func createTestPackage() *godata.GoPackage {
 				"\tfmt.Println(\"Benchmarking " + pack.Name + ":\");\n" +
 					"\ttesting.RunBenchmarks(bench_" + localPackVarName + ");\n"
 			testArrays += tmpStr
+			stdImports["testing"] = true
+			stdImports["fmt"] = true
+		}
+
+		// the coverage counters are read from the package under test, which
+		// needs to be imported even if it only has an external test package
+		if *flagCover && coverPackage(pack) {
+			localPackName := getLocalPackageName(pack.Name)
+			coverEntries += "\t__cover__{ \"" + pack.Name + "\", " +
+				localPackName + ".GobuildCoverBlocks, " +
+				localPackName + ".GobuildCoverCounts },\n"
+			if !pack.HasTestFiles() {
+				packImports += "import \"" + pack.Name + "\"\n"
+			}
+			usedPacks[pack] = true
 		}
+
+		// packages without any test functions are still imported to make
+		// sure they compile
+		for _, tpack := range testFilePacks {
+			if usedPacks[tpack] {
+				packImports += "import \"" + tpack.Name + "\"\n"
+			} else {
+				packImports += "import _ \"" + tpack.Name + "\"\n"
+			}
+		}
+	}
+
+	// _testmain only knows -fuzz if there are fuzz functions
+	if *flagFuzz != "" && *flagRunExec && fuzzTargets == "" {
+		testLog.Error("Can't use -fuzz %s, no fuzz functions found.\n", *flagFuzz)
+		os.Exit(1)
+	}
+
+	if fuzzTargets != "" {
+		for _, imp := range fuzzRunnerImports {
+			stdImports[imp] = true
+		}
+		// __runFuzzCorpus__ takes a *testing.T
+		stdImports["testing"] = true
+		usesRegexp = true
+		testArrays += "var __fuzzTargets__ = []__fuzzTarget__ {\n" + fuzzTargets + "}\n\n"
+		// with -fuzz _testmain only fuzzes and exits
+		testCalls = "\t__fuzz__(__fuzzTargets__);\n" + testCalls
+	}
+
+	if *flagCover {
+		for _, imp := range coverWriterImports {
+			stdImports[imp] = true
+		}
+		usesRegexp = true
+		testArrays += "const __coverProfile__ = \"" + coverProfile + "\"\n\n"
+		testArrays += "var __coverage__ = []__cover__ {\n" + coverEntries + "}\n\n"
+		if stdImports["bytes"] {
+			testCalls = "\t__examplesFailed__ = __writeCoverProfile__;\n" + testCalls
+		}
+		testCalls += "\t__writeCoverProfile__();\n"
+	}
+
+	for _, imp := range skipCheckImports {
+		stdImports[imp] = true
+	}
+
+	// imports, only the ones used by the generated code (e.g. no testing if
+	// there are only examples)
+	testFileSource = "package main\n\n"
+	for _, imp := range getSortedKeys(stdImports) {
+		testFileSource += "import \"" + imp + "\"\n"
+	}
+	if usesRegexp {
+		testFileSource += "import __regexp__ \"regexp\"\n"
+	}
+	// the example runner uses the -match and -v flags of the testing package
+	if usesExamples && !stdImports["testing"] {
+		testFileSource += "import _ \"testing\"\n"
+	}
+	testFileSource += packImports
+
+	if stdImports["bytes"] {
+		testFileSource += exampleRunnerSource
+	}
+	testFileSource += skipCheckSource
+	if fuzzTargets != "" {
+		testFileSource += fuzzRunnerSource
+	}
+	if *flagCover {
+		testFileSource += coverWriterSource
 	}
 
 	testFileSource += "\n" + testArrays
@@ -318,17 +814,28 @@ func createTestPackage() *godata.GoPackage {
 			benchCalls +
 			"}\n"
 
-	testFile, err = os.Create(testGoFile.Filename)
-	if err != nil {
-		logger.Error("Could not create %s: %s\n", testGoFile.Filename, err)
-		os.Exit(1)
-	}
-	testFile.WriteString(testFileSource)
-
-	testFile.Close()
+	writeGeneratedFile(testGoFile.Filename, []byte(testFileSource))
 	return testPack
 }
 
+/*
+ Returns the files that are given to the compiler for a package, relative to
+ the object directory. Files in replacedFiles are replaced by their copies.
+*/
+func getCompileFiles(pack *godata.GoPackage) (files []string) {
+	for _, gf := range pack.GetSourceFiles(*flagTesting) {
+		filename := gf.Filename
+		if replacedFile, exists := replacedFiles[filename]; exists {
+			filename = replacedFile
+		}
+		files = append(files, fromObjDir(filename))
+	}
+	if counterFile, exists := coverCounterFiles[pack.Name]; exists {
+		files = append(files, fromObjDir(counterFile))
+	}
+	return
+}
+
 /*
  The compile method will run the compiler for every package it has found,
  starting with the main package.
@@ -338,11 +845,11 @@ func compile(pack *godata.GoPackage) bool {
 	var argc int
 	var argv []string
 	var argvFilled int
-	var objDir = "" //outputDirPrefix + getObjDir();
+	var objDir = getObjDir()
 
 	// check for recursive dependencies
 	if pack.InProgress {
-		logger.Error("Found a recurisve dependency in %s. This is not supported in Go.\n", pack.Name)
+		compileLog.Error("Found a recurisve dependency in %s. This is not supported in Go.\n", pack.Name)
 		pack.HasErrors = true
 		pack.InProgress = false
 		return false
@@ -378,31 +885,32 @@ func compile(pack *godata.GoPackage) bool {
 			pack.InProgress = false
 			return true
 		} else {
-			logger.Error("Can't compile cgo files. Please manually compile them.\n")
+			compileLog.Error("Can't compile cgo files. Please manually compile them.\n")
 			os.Exit(1)
 		}
 	}
 
 	// check if this package has any files (if not -> error)
 	if pack.Files.Len() == 0 && pack.Type == godata.LOCAL_PACKAGE {
-		logger.Error("No files found for package %s.\n", pack.Name)
+		compileLog.Error("No files found for package %s.\n", pack.Name)
 		os.Exit(1)
 	}
 
-	// if the outputDirPrefix points to something, subdirectories
-	// need to be created if they don't already exist
-	outputFile := objDir + pack.OutputFile
-	if strings.Index(outputFile, "/") != -1 {
-		path := outputFile[0:strings.LastIndex(outputFile, "/")]
+	// the output file is relative to the object directory, if one of them
+	// points to something, subdirectories need to be created if they don't
+	// already exist
+	outputFile := pack.OutputFile
+	if strings.Index(objDir+outputFile, "/") != -1 {
+		path := (objDir + outputFile)[0:strings.LastIndex(objDir+outputFile, "/")]
 		dir, err := os.Stat(path)
 		if err != nil {
-			err = os.MkdirAll(path, rootPathPerm)
+			err = makeDirectory(path)
 			if err != nil {
-				logger.Error("Could not create output path %s: %s\n", path, err)
+				compileLog.Error("Could not create output path %s: %s\n", path, err)
 				os.Exit(1)
 			}
 		} else if !dir.IsDirectory() {
-			logger.Error("File found in %s instead of a directory.\n", path)
+			compileLog.Error("File found in %s instead of a directory.\n", path)
 			os.Exit(1)
 		}
 	}
@@ -411,28 +919,26 @@ func compile(pack *godata.GoPackage) bool {
 	// this is done because the compiler/linker looks for .a files
 	// before it looks for .[568] files
 	if !*flagKeepAFiles {
-		if err := os.Remove(outputFile + ".a"); err == nil {
-			logger.Debug("Removed file %s.a.\n", outputFile)
+		if err := removeFile(objDir + outputFile + ".a"); err == nil {
+			compileLog.Debug("Removed file %s%s.a.\n", objDir, outputFile)
 		}
 	}
 
 	// construct compiler command line arguments
-	if pack.Name != "main" {
-		logger.Info("Compiling %s...\n", pack.Name)
-	} else {
-		logger.Info("Compiling %s (%s)...\n", pack.Name, pack.OutputFile)
-	}
-
-	argc = pack.Files.Len() + 3
+	sourceFiles := getCompileFiles(pack)
+	argc = len(sourceFiles) + 3
 	if *flagIncludePaths != "" {
 		argc += 2 * (strings.Count(*flagIncludePaths, ",") + 1)
 	}
-	if pack.NeedsLocalSearchPath() || objDir != "" {
+	if pack.NeedsLocalSearchPath() {
 		argc += 2
 	}
 	if pack.Name == "main" {
 		argc += 2
 	}
+	if needsRootSearchPath(pack) {
+		argc += 2
+	}
 	argv = make([]string, argc*2)
 
 	argv[argvFilled] = compilerBin
@@ -446,24 +952,20 @@ func compile(pack *godata.GoPackage) bool {
 		for _, includePath := range strings.Split(*flagIncludePaths, ",", -1) {
 			argv[argvFilled] = "-I"
 			argvFilled++
-			argv[argvFilled] = includePath
+			argv[argvFilled] = fromObjDir(includePath)
 			argvFilled++
 		}
 	}
 	// 	for _, arg := range argv {
-	// 		logger.Info(arg)
-	// 		logger.Info(" ")
+	// 		compileLog.Info(arg)
+	// 		compileLog.Info(" ")
 	// 	}
-	// 	logger.Info("\n")
+	// 	compileLog.Info("\n")
 
-	if pack.NeedsLocalSearchPath() || objDir != "" {
+	if pack.NeedsLocalSearchPath() {
 		argv[argvFilled] = "-I"
 		argvFilled++
-		if objDir != "" {
-			argv[argvFilled] = objDir
-		} else {
-			argv[argvFilled] = "."
-		}
+		argv[argvFilled] = "."
 		argvFilled++
 	}
 	if pack.Name == "main" {
@@ -472,26 +974,51 @@ func compile(pack *godata.GoPackage) bool {
 		argv[argvFilled] = "."
 		argvFilled++
 	}
+	if needsRootSearchPath(pack) {
+		argv[argvFilled] = "-I"
+		argvFilled++
+		argv[argvFilled] = fromObjDir(".")
+		argvFilled++
+	}
 
-	for i := 0; i < pack.Files.Len(); i++ {
-		gf := pack.Files.At(i).(*godata.GoFile)
-		argv[argvFilled] = gf.Filename
+	for _, filename := range sourceFiles {
+		argv[argvFilled] = filename
 		argvFilled++
 	}
 
-	logger.Info("    %s\n", getCommandline(argv[0:argvFilled]))
-	cmd, err := exec.Run(compilerBin, argv[0:argvFilled], os.Environ(), rootPath,
-		exec.DevNull, exec.PassThrough, exec.PassThrough)
-	if err != nil {
-		logger.Error("%s\n", err)
-		os.Exit(1)
+	// -incremental: skip packages that are up to date
+	var state *buildState
+	if *flagIncremental {
+		state = getBuildState(pack, argv[0:argvFilled-len(sourceFiles)], sourceFiles)
+		reason := getRebuildReason(pack, state)
+		if reason == "" {
+			compileLog.Debug("%s is up to date.\n", pack.Name)
+			// counts as built for the status area
+			logger.ProgressEnd("compiling "+pack.Name, true, true)
+			pack.Compiled = true
+			pack.InProgress = false
+			return true
+		}
+		if *flagExplain {
+			compileLog.Info("Rebuilding %s: %s\n", pack.Name, reason)
+		}
 	}
 
-	waitmsg, err := cmd.Wait(0)
+	if pack.Name != "main" {
+		compileLog.Info("Compiling %s...\n", pack.Name)
+	} else {
+		compileLog.Info("Compiling %s (%s)...\n", pack.Name, pack.OutputFile)
+	}
+	if !*flagDryRun && !*flagPrintCommands {
+		compileLog.Info("    %s\n", getCommandline(argv[0:argvFilled]))
+	}
+	logger.ProgressBegin("compiling " + pack.Name)
+	waitmsg, err := runTaskCommand(pack.Name, argv[0:argvFilled], path.Join(rootPath, objDir))
 	if err != nil {
-		logger.Error("Compiler execution error (%s), aborting compilation.\n", err)
+		compileLog.Error("Compiler execution error (%s), aborting compilation.\n", err)
 		os.Exit(1)
 	}
+	logger.ProgressEnd("compiling "+pack.Name, true, waitmsg.ExitStatus() == 0)
 
 	if waitmsg.ExitStatus() != 0 {
 		pack.HasErrors = true
@@ -502,6 +1029,9 @@ func compile(pack *godata.GoPackage) bool {
 	// it should now be compiled
 	pack.Compiled = true
 	pack.InProgress = false
+	if state != nil {
+		saveBuildState(pack, state)
+	}
 
 	return true
 }
@@ -513,7 +1043,6 @@ func link(pack *godata.GoPackage) bool {
 	var argc int
 	var argv []string
 	var argvFilled int
-	var objDir string = "" //outputDirPrefix + getObjDir();
 
 	// build the command line for the linker
 	argc = 4
@@ -526,6 +1055,9 @@ func link(pack *godata.GoPackage) bool {
 	if pack.Name == "main" {
 		argc += 2
 	}
+	if needsRootSearchPath(pack) {
+		argc += 2
+	}
 
 	argv = make([]string, argc*3)
 
@@ -533,13 +1065,13 @@ func link(pack *godata.GoPackage) bool {
 	argvFilled++
 	argv[argvFilled] = "-o"
 	argvFilled++
-	argv[argvFilled] = outputDirPrefix + pack.OutputFile
+	argv[argvFilled] = fromObjDir(outputDirPrefix + pack.OutputFile)
 	argvFilled++
 	if *flagIncludePaths != "" {
 		for _, v := range strings.Split(*flagIncludePaths, ",", -1) {
 			argv[argvFilled] = "-L"
 			argvFilled++
-			argv[argvFilled] = v
+			argv[argvFilled] = fromObjDir(v)
 			argvFilled++
 		}
 	}
@@ -559,26 +1091,31 @@ func link(pack *godata.GoPackage) bool {
 		argv[argvFilled] = "."
 		argvFilled++
 	}
-	argv[argvFilled] = objDir + pack.OutputFile + objExt
+	if needsRootSearchPath(pack) {
+		argv[argvFilled] = "-L"
+		argvFilled++
+		argv[argvFilled] = fromObjDir(".")
+		argvFilled++
+	}
+	argv[argvFilled] = pack.OutputFile + objExt
 	argvFilled++
 
-	logger.Info("Linking %s...\n", argv[2])
-	logger.Info("    %s\n\n", getCommandline(argv))
-
-	cmd, err := exec.Run(linkerBin, argv[0:argvFilled], os.Environ(), rootPath,
-		exec.DevNull, exec.PassThrough, exec.PassThrough)
-	if err != nil {
-		logger.Error("%s\n", err)
-		os.Exit(1)
+	linkLog.Info("Linking %s...\n", outputDirPrefix+pack.OutputFile)
+	if !*flagDryRun && !*flagPrintCommands {
+		linkLog.Info("    %s\n\n", getCommandline(argv[0:argvFilled]))
 	}
-	waitmsg, err := cmd.Wait(0)
+
+	logger.ProgressBegin("linking " + outputDirPrefix + pack.OutputFile)
+	waitmsg, err := runTaskCommand(outputDirPrefix+pack.OutputFile, argv[0:argvFilled],
+		path.Join(rootPath, getObjDir()))
 	if err != nil {
-		logger.Error("Linker execution error (%s), aborting compilation.\n", err)
+		linkLog.Error("Linker execution error (%s), aborting compilation.\n", err)
 		os.Exit(1)
 	}
+	logger.ProgressEnd("linking "+outputDirPrefix+pack.OutputFile, false, waitmsg.ExitStatus() == 0)
 
 	if waitmsg.ExitStatus() != 0 {
-		logger.Error("Linker returned with errors, aborting.\n")
+		linkLog.Error("Linker returned with errors, aborting.\n")
 		return false
 	}
 	return true
@@ -601,23 +1138,17 @@ func goyacc(filepath string) string {
 
 	goyaccPath, err := exec.LookPath("goyacc")
 	if err != nil {
-		logger.Error("%s\n", err)
+		compileLog.Error("%s\n", err)
 		os.Exit(1)
 	}
 
-	logger.Info("Parsing goyacc file %s.\n", filepath)
+	compileLog.Info("Parsing goyacc file %s.\n", filepath)
 
 	argv := []string{goyaccPath, "-o", outFilepath, filepath}
-	logger.Debug("%s\n", argv)
-	cmd, err := exec.Run(argv[0], argv, os.Environ(), rootPath,
-		exec.PassThrough, exec.PassThrough, exec.PassThrough)
+	compileLog.Debug("%s\n", argv)
+	waitmsg, err := runTaskCommand(filepath, argv, rootPath)
 	if err != nil {
-		logger.Error("%s\n", err)
-		os.Exit(1)
-	}
-	waitmsg, err := cmd.Wait(0)
-	if err != nil {
-		logger.Error("Executing goyacc failed: %s.\n", err)
+		compileLog.Error("Executing goyacc failed: %s.\n", err)
 		os.Exit(1)
 	}
 
@@ -625,6 +1156,10 @@ func goyacc(filepath string) string {
 		os.Exit(waitmsg.ExitStatus())
 	}
 
+	if _, err = os.Stat(outFilepath); err != nil && *flagDryRun {
+		compileLog.Warn("%s doesn't exist yet, its imports are unknown.\n", outFilepath)
+		return ""
+	}
 	return outFilepath
 }
 
@@ -632,6 +1167,11 @@ func goyacc(filepath string) string {
  Executes something. Used for the -run command line option.
 */
 func runExec(argv []string) {
+	printCommand(argv, rootPath)
+	if *flagDryRun {
+		return
+	}
+
 	logger.Info("Executing %s:\n", argv[0])
 	logger.Debug("%s\n", getCommandline(argv))
 	cmd, err := exec.Run(argv[0], argv, os.Environ(), rootPath,
@@ -656,15 +1196,15 @@ func runExec(argv []string) {
  Creates a .a file for a single GoPackage
 */
 func packLib(pack *godata.GoPackage) {
-	var objDir string = "" //outputDirPrefix + getObjDir();
+	var objDir string = getObjDir()
 
 	// ignore packages that need to be build manually (like cgo packages)
 	if pack.HasCGOFiles() {
-		logger.Debug("Skipped %s.a because it can't be build with gobuild.\n", pack.Name)
+		linkLog.Debug("Skipped %s.a because it can't be build with gobuild.\n", pack.Name)
 		return
 	}
 
-	logger.Info("Creating %s.a...\n", pack.Name)
+	linkLog.Info("Creating %s.a...\n", pack.Name)
 
 	argv := []string{
 		gopackBin,
@@ -673,24 +1213,24 @@ func packLib(pack *godata.GoPackage) {
 		objDir + pack.Name + objExt,
 	}
 
-	logger.Debug("%s\n", getCommandline(argv))
-	cmd, err := exec.Run(gopackBin, argv, os.Environ(), rootPath,
-		exec.DevNull, exec.PassThrough, exec.PassThrough)
+	linkLog.Debug("%s\n", getCommandline(argv))
+	logger.ProgressBegin("packing " + pack.Name)
+	waitmsg, err := runTaskCommand(pack.Name, argv, rootPath)
 	if err != nil {
-		logger.Error("%s\n", err)
-		os.Exit(1)
-	}
-	waitmsg, err := cmd.Wait(0)
-	if err != nil {
-		logger.Error("gopack execution error (%s), aborting.\n", err)
+		linkLog.Error("gopack execution error (%s), aborting.\n", err)
 		os.Exit(1)
 	}
+	logger.ProgressEnd("packing "+pack.Name, false, waitmsg.ExitStatus() == 0)
 
 	if waitmsg.ExitStatus() != 0 {
-		logger.Error("gopack returned with errors, aborting.\n")
+		linkLog.Error("gopack returned with errors, aborting.\n")
 		os.Exit(waitmsg.ExitStatus())
 	}
-	os.Remove(objDir + pack.Name + objExt)
+	// -incremental needs the object file to know that the package is up to
+	// date
+	if !*flagIncremental {
+		removeFile(objDir + pack.Name + objExt)
+	}
 }
 
 
@@ -723,9 +1263,18 @@ func buildExecutable() {
 		if *flagRunExec {
 			executables = make([]string, flag.NArg())
 		}
+		var mainPacks []*godata.GoPackage
+		for _, fn := range flag.Args() {
+			if mainPack, exists := goPackages.GetMain(fn, !*flagSingleMainFile); exists {
+				mainPacks = append(mainPacks, mainPack)
+			}
+		}
+		startBuildProgress(mainPacks)
+
 		for _, fn := range flag.Args() {
 			mainPack, exists := goPackages.GetMain(fn, !*flagSingleMainFile)
 			if !exists {
+				logger.FinishProgress()
 				logger.Error("File %s not found.\n", fn)
 				return // or os.Exit?
 			}
@@ -749,7 +1298,10 @@ func buildExecutable() {
 		if *flagRunExec {
 			executables = make([]string, goPackages.GetMainCount())
 		}
-		for _, mainPack := range goPackages.GetMainPackages(!*flagSingleMainFile) {
+		mainPacks := goPackages.GetMainPackages(!*flagSingleMainFile)
+		startBuildProgress(mainPacks)
+
+		for _, mainPack := range mainPacks {
 
 			if compile(mainPack) {
 				if link(mainPack) {
@@ -766,6 +1318,7 @@ func buildExecutable() {
 			}
 		}
 	}
+	logger.FinishProgress()
 
 	if *flagRunExec && !linkErrors && !compileErrors {
 		for i := 0; i < execFilled; i++ {
@@ -814,6 +1367,14 @@ func buildLibrary() {
 		packNames = goPackages.GetPackageNames()
 	}
 
+	var libPacks []*godata.GoPackage
+	for _, name := range packNames {
+		if pack, exists = goPackages.Get(name); exists && name != "main" {
+			libPacks = append(libPacks, pack)
+		}
+	}
+	startBuildProgress(libPacks)
+
 	// loop over all packages, compile them and build a .a file
 	for _, name := range packNames {
 
@@ -849,6 +1410,7 @@ func buildLibrary() {
 			packLib(pack)
 		}
 	}
+	logger.FinishProgress()
 }
 
 /*
@@ -857,15 +1419,24 @@ func buildLibrary() {
  case -benchmarks/-match/-v are also passed on.
 */
 func buildTestExecutable() {
+	// -changed/-since: only test the affected packages
+	affected := getAffectedPackages()
+	if affected != nil && len(affected) == 0 {
+		testLog.Info("No packages affected by the changes.\n")
+		return
+	}
+
 	// this will create a file called "_testmain.go"
-	testPack := createTestPackage()
+	testPack := createTestPackage(affected)
 
+	startBuildProgress([]*godata.GoPackage{testPack})
 	if compile(testPack) {
 		linkErrors = !link(testPack) || linkErrors
 	} else {
-		logger.Error("Can't link executable because of compile errors.\n")
+		testLog.Error("Can't link executable because of compile errors.\n")
 		compileErrors = true
 	}
+	logger.FinishProgress()
 
 	// delete temporary _testmain.go file
 	// 	os.Remove("_testmain.go")
@@ -875,38 +1446,219 @@ func buildTestExecutable() {
 	}
 
 	if *flagRunExec {
-		var argvFilled int
-		var argc int = 1
-		if *flagMatch != "" {
-			argc += 2
+		var report = new(TestReport)
+		var exitStatus int
+
+		argv := getTestArgv(testPack, *flagMatch)
+		if *flagDryRun {
+			printCommand(argv, rootPath)
+			return
 		}
-		if *flagBenchmarks != "" {
-			argc += 2
+		cacheKeys := getTestCacheKeys(argv)
+		cached := replayCachedTests(cacheKeys)
+
+		// benchmarks and fuzzing are never cached
+		if len(cached) < len(testedPackages) || *flagBenchmarks != "" || *flagFuzz != "" {
+			report, exitStatus = runTestExec(argv)
 		}
-		if *flagVerboseMode {
-			argc++
+		report.Packages = append(cached, report.Packages...)
+
+		// -retry: run the failed tests (and those that didn't run because
+		// of them) again until they pass
+		if exitStatus != 0 && *flagRetry > 0 && *flagFuzz == "" {
+			pending := getRetryTests(report, getMatchingTests())
+			for run := 2; run <= *flagRetry+1 && exitStatus != 0 && len(pending) > 0; run++ {
+				testLog.Info("Retrying %d test(s) (run %d of %d):\n", len(pending), run, *flagRetry+1)
+				var retryReport *TestReport
+				retryReport, exitStatus = runTestExec(getTestArgv(testPack, getRetryMatch(pending)))
+				mergeTestReports(report, retryReport)
+				pending = getRetryTests(retryReport, pending)
+			}
 		}
-		argv := make([]string, argc)
-		argv[argvFilled] = outputDirPrefix + testPack.OutputFile
-		argvFilled++
-		if *flagMatch != "" {
-			argv[argvFilled] = "-match"
-			argvFilled++
-			argv[argvFilled] = *flagMatch
-			argvFilled++
+		if *flagRetry > 0 {
+			reportFlakyTests(report)
 		}
-		if *flagBenchmarks != "" {
-			argv[argvFilled] = "-benchmarks"
-			argvFilled++
-			argv[argvFilled] = *flagBenchmarks
-			argvFilled++
+		saveTestCache(report, cacheKeys, exitStatus)
+
+		writeTestReports(report)
+
+		// the profile is written even if tests failed
+		if *flagCover {
+			if packs, err := readCoverProfile(coverProfile); err == nil {
+				printCoverage(packs)
+			} else {
+				testLog.Warn("Could not read coverage profile: %s\n", err)
+			}
 		}
-		if *flagVerboseMode {
-			argv[argvFilled] = "-v"
-			argvFilled++
+		if exitStatus != 0 {
+			os.Exit(exitStatus)
+		}
+
+		if !handleBenchmarkResults(report.Benchmarks) {
+			os.Exit(1)
+		}
+	}
+}
+
+/*
+ Shows the status area of the logger (if stdout is a terminal) for building
+ the packages, the total is the number of packages that have to be compiled
+ for them, including their dependencies.
+*/
+func startBuildProgress(packs []*godata.GoPackage) {
+	if *flagDryRun {
+		// the commands are the output
+		return
+	}
+
+	counted := make(map[*godata.GoPackage]bool)
+	var count func(pack *godata.GoPackage)
+	count = func(pack *godata.GoPackage) {
+		if counted[pack] || pack.Compiled || pack.HasCGOFiles() {
+			return
+		}
+		counted[pack] = true
+		for _, idep := range *pack.Depends {
+			dep := idep.(*godata.GoPackage)
+			if dep.Type == godata.LOCAL_PACKAGE ||
+				dep.Type == godata.UNKNOWN_PACKAGE && dep.Files.Len() > 0 {
+				count(dep)
+			}
 		}
+	}
+
+	for _, pack := range packs {
+		if pack.Files.Len() > 0 && pack.Type != godata.REMOTE_PACKAGE {
+			count(pack)
+		}
+	}
+	logger.StartProgress(len(counted))
+}
+
+/*
+ Runs a build tool in dir and waits for it. Its stdout and stderr are the
+ output and error output of the task (see logger.Task), so errors still go
+ to stderr. Both are dropped while building mutants (see quietBuild). All
+ build commands go through here, -x prints them and -n only prints them and
+ pretends they succeeded.
+*/
+func runTaskCommand(task string, argv []string, dir string) (*os.Waitmsg, os.Error) {
+	printCommand(argv, dir)
+	if *flagDryRun {
+		return new(os.Waitmsg), nil
+	}
+
+	if quietBuild {
+		cmd, err := exec.Run(argv[0], argv, os.Environ(), dir, exec.DevNull, exec.DevNull, exec.DevNull)
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Wait(0)
+	}
+
+	cmd, err := exec.Run(argv[0], argv, os.Environ(), dir, exec.DevNull, exec.Pipe, exec.Pipe)
+	if err != nil {
+		return nil, err
+	}
+	errOutputDone := make(chan bool)
+	go func() {
+		errOutput := logger.NewErrorTask(task)
+		io.Copy(errOutput, cmd.Stderr)
+		errOutput.Close()
+		errOutputDone <- true
+	}()
+	output := logger.NewTask(task)
+	io.Copy(output, cmd.Stdout)
+	output.Close()
+	<-errOutputDone
+	return cmd.Wait(0)
+}
 
-		runExec(argv)
+/*
+ Returns the command line for running _testmain: the executable and the
+ -match/-benchmarks/-v options passed on to it.
+*/
+func getTestArgv(testPack *godata.GoPackage, match string) []string {
+	argv := []string{outputDirPrefix + testPack.OutputFile}
+	if match != "" {
+		argv = append(argv, "-match", match)
+	}
+	if *flagBenchmarks != "" {
+		argv = append(argv, "-benchmarks", *flagBenchmarks)
+	}
+	if *flagFuzz != "" {
+		fuzzTime, err := parseDuration(*flagFuzzTime)
+		if err != nil {
+			testLog.Error("Invalid -fuzztime: %s\n", err)
+			os.Exit(1)
+		}
+		argv = append(argv, "-fuzz", *flagFuzz, "-fuzztime", strconv.Itoa64(fuzzTime))
+	}
+	if *flagVerboseMode || needsVerboseTestOutput() {
+		argv = append(argv, "-v")
+	}
+	return argv
+}
+
+/*
+ Sets the verbosity level of the logger selected with -q/-qq/-v.
+*/
+func setVerbosityLevel() {
+	if *flagQuieterMode {
+		logger.SetVerbosityLevel(logger.ERROR)
+	} else if *flagQuietMode {
+		logger.SetVerbosityLevel(logger.WARN)
+	} else if *flagVerboseMode {
+		logger.SetVerbosityLevel(logger.DEBUG)
+	} else {
+		logger.SetVerbosityLevel(logger.DEFAULT)
+	}
+}
+
+/*
+ Sets up the sinks, output mode and component levels of the logger for
+ -log-file, -log-format, -output and -log-levels. Without -log-file the
+ format is used for stdout, with -log-file stdout keeps the normal text
+ output and the file gets timestamps. With -n and -x all messages go to
+ stderr, stdout only gets the commands. The same for the events of
+ -test-events if they are written to stdout.
+*/
+func setupLogging() {
+	formatter, err := logger.NewFormatter(*flagLogFormat, *flagLogFile != "")
+	if err != nil {
+		logger.Error("Invalid -log-format: %s\n", err)
+		os.Exit(1)
+	}
+
+	terminalFormatter := formatter
+	if *flagLogFile != "" {
+		terminalFormatter = &logger.TextFormatter{}
+	}
+	terminalSink := logger.NewTerminalSink(terminalFormatter)
+	if *flagDryRun || *flagPrintCommands || *flagTestEvents == "-" {
+		terminalSink = logger.NewStderrSink(terminalFormatter)
+	}
+	logger.SetSinks(terminalSink)
+
+	if *flagLogFile != "" {
+		sink, err := logger.NewFileSink(*flagLogFile, formatter)
+		if err != nil {
+			logger.Error("Could not create log file: %s\n", err)
+			os.Exit(1)
+		}
+		logger.AddSink(sink)
+	}
+
+	outputMode, err := logger.ParseOutputMode(*flagOutput)
+	if err != nil {
+		logger.Error("Invalid -output: %s\n", err)
+		os.Exit(1)
+	}
+	logger.SetOutputMode(outputMode)
+
+	if err = logger.SetComponentLevels(*flagLogLevels); err != nil {
+		logger.Error("Invalid -log-levels: %s\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -923,12 +1675,19 @@ func clean() {
 	argv := []string{bashBin, "-c", "commandhere"}
 
 	if *flagVerboseMode {
-		argv[2] = "rm -rfv *.[568]"
+		argv[2] = "rm -rfv *.[568] _test _state"
 	} else {
-		argv[2] = "rm -rf *.[568]"
+		argv[2] = "rm -rf *.[568] _test _state"
 	}
 
 	logger.Info("Running: %v\n", argv[2:])
+	// not quoted, the shell has to expand *.[568]
+	if *flagDryRun || *flagPrintCommands {
+		logger.Print("%s\n", argv[2])
+	}
+	if *flagDryRun {
+		return
+	}
 
 	cmd, err := exec.Run(bashBin, argv, os.Environ(), rootPath,
 		exec.DevNull, exec.PassThrough, exec.PassThrough)
@@ -966,13 +1725,8 @@ func main() {
 	// parse command line arguments
 	flag.Parse()
 
-	if *flagQuieterMode {
-		logger.SetVerbosityLevel(logger.ERROR)
-	} else if *flagQuietMode {
-		logger.SetVerbosityLevel(logger.WARN)
-	} else if *flagVerboseMode {
-		logger.SetVerbosityLevel(logger.DEBUG)
-	}
+	setVerbosityLevel()
+	setupLogging()
 
 	if *flagClean {
 		clean()
@@ -1070,11 +1824,60 @@ func main() {
 
 	}
 
+	if *flagCoverReport {
+		coverReport()
+		os.Exit(0)
+	}
+
+	// mutation testing is a test build
+	if *flagMutate != "" {
+		if *flagDryRun {
+			logger.Error("-n can't be used together with -mutate.\n")
+			os.Exit(1)
+		}
+		*flagTesting = true
+	}
+
+	if *flagCover && !*flagTesting {
+		logger.Warn("-cover is only used together with -t.\n")
+	}
+	if (*flagChanged || *flagSince != "") && !*flagTesting {
+		logger.Warn("-changed and -since are only used together with -t.\n")
+	}
+
+	if *flagExplain && !*flagIncremental {
+		logger.Warn("-explain is only used together with -incremental.\n")
+	}
+
 	// read all go files in the current path + subdirectories and parse them
 	logger.Info("Parsing go file(s)...\n")
+	if !*flagNoScanCache {
+		scanCache = godata.LoadScanCache(SCAN_CACHE_FILE)
+	}
 	readFiles(rootPath)
+	parseFiles()
+	if scanCache != nil && !*flagDryRun {
+		if err = scanCache.Save(); err != nil {
+			logger.Warn("Could not save the scan cache: %s\n", err)
+		}
+	}
 
-	if *flagTesting {
+	if *flagWhy != "" {
+		if !printWhy() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *flagQuery != "" {
+		if !runQuery(*flagQuery) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *flagMutate != "" {
+		mutationTest()
+	} else if *flagTesting {
 		buildTestExecutable()
 	} else if *flagLibrary {
 		buildLibrary()
@@ -0,0 +1,181 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ A cache for the results of parsing files, so only files that changed since
+ the last run have to be parsed again.
+*/
+package godata
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"strings"
+	"sync"
+)
+
+// changes whenever the content of scannedFile changes, older caches are
+// ignored
+const SCAN_CACHE_VERSION = 1
+
+// an import of a file
+type scannedImport struct {
+	Name  string // package name without "./"
+	Local bool   // imported with "./name"
+}
+
+// everything that parsing a file found out, see GoFile.ParseFileCached
+type scannedFile struct {
+	Mtime              int64  // in ns, together with Size it tells if the file changed
+	Size               int64  // without reading it
+	Hash               string // sha1 of the content
+	Package            string
+	Imports            []scannedImport
+	Warnings           []string // printed when the file is added to a container
+	HasMain            bool
+	IsCGOFile          bool
+	TestFunctions      []string
+	BenchmarkFunctions []string
+	ExampleFunctions   []*Example
+	FuzzFunctions      []string
+}
+
+/*
+ Stores a warning. Same syntax as fmt.Printf.
+*/
+func (this *scannedFile) warn(format string, v ...interface{}) {
+	this.Warnings = append(this.Warnings, fmt.Sprintf(format, v...))
+}
+
+// ================================
+// =========== ScanCache ==========
+// ================================
+
+// the cache file
+type scanCacheData struct {
+	Version int
+	Files   map[string]*scannedFile
+}
+
+/*
+ Parse results of the last run (see LoadScanCache). Files that are looked up
+ or parsed are kept for the next run, all others are dropped when saving.
+ Files can be looked up and added by several goroutines at the same time.
+*/
+type ScanCache struct {
+	mutex    sync.Mutex
+	filename string
+	old      map[string]*scannedFile
+	current  map[string]*scannedFile
+	changed  bool // true = the cache file has to be written
+	parsed   int  // number of files that weren't in the cache
+}
+
+/*
+ Loads the cache from a file. If it doesn't exist or can't be read the cache
+ is empty.
+*/
+func LoadScanCache(filename string) *ScanCache {
+	cache := &ScanCache{filename: filename, old: make(map[string]*scannedFile),
+		current: make(map[string]*scannedFile)}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return cache
+	}
+	cacheData := new(scanCacheData)
+	if err = json.Unmarshal(data, cacheData); err != nil || cacheData.Version != SCAN_CACHE_VERSION {
+		scanLog.Debug("Ignoring scan cache %s.\n", filename)
+		return cache
+	}
+	if cacheData.Files != nil {
+		cache.old = cacheData.Files
+	}
+	return cache
+}
+
+/*
+ Writes the cache back to its file (including the directory), unless
+ nothing changed.
+*/
+func (this *ScanCache) Save() os.Error {
+	scanLog.Debug("Parsed %d file(s), %d from the scan cache.\n", this.parsed, len(this.current)-this.parsed)
+
+	if !this.changed && len(this.current) == len(this.old) {
+		return nil
+	}
+	data, err := json.Marshal(&scanCacheData{SCAN_CACHE_VERSION, this.current})
+	if err != nil {
+		return err
+	}
+	if idx := strings.LastIndex(this.filename, "/"); idx >= 0 {
+		if err = os.MkdirAll(this.filename[0:idx], 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(this.filename, data, 0644)
+}
+
+/*
+ Returns the parse result of a file if it didn't change: same modification
+ time and size or, if one of them changed, the same content. Returns nil
+ otherwise. The file is read without holding the lock.
+*/
+func (this *ScanCache) get(filename string) *scannedFile {
+	this.mutex.Lock()
+	scanned, exists := this.old[filename]
+	this.mutex.Unlock()
+	if !exists {
+		return nil
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil
+	}
+	touched := stat.Mtime_ns != scanned.Mtime || stat.Size != scanned.Size
+	if touched {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil || hashContent(data) != scanned.Hash {
+			return nil
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if touched {
+		// the content is the same, only the stat changed
+		scanned.Mtime, scanned.Size = stat.Mtime_ns, stat.Size
+		this.changed = true
+	}
+	this.current[filename] = scanned
+	return scanned
+}
+
+/*
+ Adds the parse result of a file to the cache.
+*/
+func (this *ScanCache) put(filename string, scanned *scannedFile, data []byte) {
+	if stat, err := os.Stat(filename); err == nil {
+		scanned.Mtime, scanned.Size = stat.Mtime_ns, stat.Size
+	}
+	scanned.Hash = hashContent(data)
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.current[filename] = scanned
+	this.changed = true
+	this.parsed++
+}
+
+func hashContent(data []byte) string {
+	h := sha1.New()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum())
+}
@@ -11,14 +11,21 @@ import (
 	"strings"
 	"os"
 	"go/ast"
+	"go/doc"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
+	"unicode"
+	"utf8"
 	"./logger"
 	"container/vector"
 )
 
 var DefaultOutputFileName string
 
+// messages about scanning and parsing the files
+var scanLog = logger.Get("scan")
+
 // Returns the greater of both numbers.
 func max(a, b int) int {
 	if a > b {
@@ -39,6 +46,19 @@ type GoFile struct {
 	IsTestFile         bool           // files with "_test.go" suffix
 	TestFunctions      *vector.Vector // vector of all test functions (name only)
 	BenchmarkFunctions *vector.Vector // vector of all benchmark functions (name only)
+	ExampleFunctions   *vector.Vector // vector of all example functions (*Example)
+	FuzzFunctions      *vector.Vector // vector of all fuzz functions (name only)
+	Imports            *vector.Vector // vector of all imported packages (*GoPackage)
+}
+
+/*
+ An Example* function from a test file. The expected output is the text of
+ an "// Output:" comment at the end of the function body.
+*/
+type Example struct {
+	Name      string // name of the example function
+	Output    string // expected output without leading/trailing white space
+	HasOutput bool   // false = no output comment, the example is only compiled
 }
 
 
@@ -47,30 +67,126 @@ type GoFile struct {
  main function.
 */
 func (this *GoFile) ParseFile(packs *GoPackageContainer) (err os.Error) {
+	return this.ParseFileCached(packs, nil)
+}
+
+/*
+ Like ParseFile, but the result is taken from the cache if the file didn't
+ change since it was parsed the last time. Newly parsed files are added to
+ the cache. The cache may be nil.
+*/
+func (this *GoFile) ParseFileCached(packs *GoPackageContainer, cache *ScanCache) (err os.Error) {
+	this.apply(this.scan(cache), packs)
+	return
+}
+
+/*
+ Parses files with a number of workers at the same time and adds them to
+ the container in the order of the slice, so the result is always the
+ same. The cache may be nil.
+*/
+func ParseFiles(files []*GoFile, packs *GoPackageContainer, cache *ScanCache, workers int) {
+	results := make([]*scannedFile, len(files))
+	done := make([]chan bool, len(files))
+
+	jobs := make(chan int, len(files))
+	for i, _ := range files {
+		done[i] = make(chan bool, 1)
+		jobs <- i
+	}
+	close(jobs)
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				results[i] = files[i].scan(cache)
+				done[i] <- true
+			}
+		}()
+	}
+
+	for i, gf := range files {
+		<-done[i]
+		gf.apply(results[i], packs)
+	}
+}
+
+/*
+ Returns the parse result of the file, from the cache if it didn't change.
+ Can be called for different files at the same time.
+*/
+func (this *GoFile) scan(cache *ScanCache) *scannedFile {
+	if cache != nil {
+		if scanned := cache.get(this.Filename); scanned != nil {
+			return scanned
+		}
+	}
+
+	data, err := ioutil.ReadFile(this.Filename)
+	if err != nil {
+		scanLog.Error("%s\n", err)
+		os.Exit(1)
+	}
+	scanned := this.parse(data)
+	if cache != nil {
+		cache.put(this.Filename, scanned, data)
+	}
+	return scanned
+}
+
+// all files are parsed into the same file set
+var fileSet = token.NewFileSet()
+
+/*
+ Parses the content of the file. Warnings are stored in the result and
+ printed when it's added to a container (see apply).
+ Only the imports are parsed unless more is needed: the whole file for the
+ main function of package main and the test functions of test files.
+*/
+func (this *GoFile) parse(data []byte) *scannedFile {
 	var packName string
 	var fileast *ast.File
+	var mode uint = parser.ImportsOnly
+	var err os.Error
+	var fset *token.FileSet = fileSet
+	var scanned = new(scannedFile)
+
+	// comments are only needed for the output of examples
+	if this.IsTestFile {
+		mode = parser.ParseComments
+	}
 
-	if fileast, err = parser.ParseFile(token.NewFileSet(), this.Filename, nil, 0); err != nil {
-		logger.Error("%s\n", err)
+	if fileast, err = parser.ParseFile(fset, this.Filename, data, mode); err != nil {
+		scanLog.Error("%s\n", err)
 		os.Exit(1)
 	}
+	if mode == parser.ImportsOnly && fileast.Name.String() == "main" {
+		if fileast, err = parser.ParseFile(fset, this.Filename, data, 0); err != nil {
+			scanLog.Error("%s\n", err)
+			os.Exit(1)
+		}
+	}
 
 	packName = fileast.Name.String()
 
-	if err != nil {
-		logger.Warn("Parsing file %s returned with errors: %s\n", this.Filename, err)
+	// external test packages (package foo_test) are in the same directory
+	// as package foo, so the path check is done without the suffix
+	var testSuffix string
+	if this.IsTestFile && strings.HasSuffix(packName, EXTERNAL_TEST_SUFFIX) {
+		testSuffix = EXTERNAL_TEST_SUFFIX
+		packName = packName[0 : len(packName)-len(testSuffix)]
 	}
 
 	// check if package is in the correct path
 	if packName != "main" {
 		switch strings.Count(this.Filename, "/") {
 		case 0: // no sub-directory
-			logger.Warn("File %s from package %s is not in the correct path. Should be %s.\n",
+			scanned.warn("File %s from package %s is not in the correct path. Should be %s.\n",
 				this.Filename, fileast.Name,
 				strings.Join([]string{packName, this.Filename}, "/"))
 		case 1: // one sub-directory
 			if this.Filename[0:strings.Index(this.Filename, "/")] != packName {
-				logger.Warn("File %s from package %s is not in the correct directory. Should be %s.\n",
+				scanned.warn("File %s from package %s is not in the correct directory. Should be %s.\n",
 					this.Filename, packName,
 					strings.Join([]string{packName,
 						this.Filename[strings.Index(this.Filename, "/")+1 : len(this.Filename)],
@@ -81,7 +197,7 @@ func (this *GoFile) ParseFile(packs *GoPackageContainer) (err os.Error) {
 			if this.Filename[max(strings.LastIndex(this.Filename, "/")-len(packName), 0):strings.LastIndex(this.Filename, "/")] != packName {
 
 				// NOTE: this case will result in a link-error (exit with error here?)
-				logger.Warn("File %s from package %s is not in the expected directory.\n",
+				scanned.warn("File %s from package %s is not in the expected directory.\n",
 					this.Filename, packName)
 			}
 			packName = strings.Join([]string{
@@ -91,17 +207,68 @@ func (this *GoFile) ParseFile(packs *GoPackageContainer) (err os.Error) {
 				"/")
 		}
 	}
-
-	// create empty temporary package, will be merged later
-	this.Pack = NewGoPackage(packName)
+	scanned.Package = packName + testSuffix
 
 	// find the local imports in this file
-	visitor := astVisitor{this, packs}
+	visitor := &astVisitor{scanned, this.IsTestFile, fset, fileast.Comments, ""}
 	ast.Walk(visitor, fileast)
 
-	packs.AddFile(this, packName)
+	return scanned
+}
 
-	return
+/*
+ Sets the fields of the file from a parse result, prints its warnings and
+ adds it to the container, together with the packages it imports. The
+ container is locked meanwhile.
+*/
+func (this *GoFile) apply(scanned *scannedFile, packs *GoPackageContainer) {
+	packs.mutex.Lock()
+	defer packs.mutex.Unlock()
+
+	for _, warning := range scanned.Warnings {
+		scanLog.Warn("%s", warning)
+	}
+
+	this.HasMain = scanned.HasMain
+	this.IsCGOFile = scanned.IsCGOFile
+	if this.IsTestFile {
+		for _, name := range scanned.TestFunctions {
+			this.TestFunctions.Push(name)
+		}
+		for _, name := range scanned.BenchmarkFunctions {
+			this.BenchmarkFunctions.Push(name)
+		}
+		for _, example := range scanned.ExampleFunctions {
+			this.ExampleFunctions.Push(example)
+		}
+		for _, name := range scanned.FuzzFunctions {
+			this.FuzzFunctions.Push(name)
+		}
+	}
+
+	// create empty temporary package, will be merged later
+	this.Pack = NewGoPackage(scanned.Package)
+	this.Imports = new(vector.Vector)
+
+	for _, imp := range scanned.Imports {
+		packType := UNKNOWN_PACKAGE
+		if imp.Local {
+			packType = LOCAL_PACKAGE
+		}
+
+		dep, exists := packs.Get(imp.Name)
+		if !exists {
+			dep = packs.AddNewPackage(imp.Name)
+		} else if dep.Type == LOCAL_PACKAGE {
+			packType = LOCAL_PACKAGE
+		}
+
+		dep.Type = packType
+		this.Pack.Depends.Push(dep)
+		this.Imports.Push(dep)
+	}
+
+	packs.AddFile(this, scanned.Package)
 }
 
 // ================================
@@ -110,58 +277,51 @@ func (this *GoFile) ParseFile(packs *GoPackageContainer) (err os.Error) {
 
 // this visitor looks for imports and the main function in an AST
 type astVisitor struct {
-	file  *GoFile
-	packs *GoPackageContainer
+	scanned     *scannedFile // results
+	isTestFile  bool
+	fset        *token.FileSet
+	comments    []*ast.CommentGroup
+	testingName string // name of the imported "testing" package in this file
 }
 
 /*
  Implementation of the visitor interface for ast walker.
  Returning nil stops the walker, anything else continues into the subtree
 */
-func (v astVisitor) Visit(node ast.Node) (w ast.Visitor) {
+func (v *astVisitor) Visit(node ast.Node) (w ast.Visitor) {
 	switch n := node.(type) {
 	case *ast.ImportSpec:
-		var packName string
-		var packType int
 		if (len(n.Path.Value) > 4) &&
 			(n.Path.Value[1] == '.') &&
 			(n.Path.Value[2] == '/') {
 
 			// local package found
-			packName = string(n.Path.Value[3 : len(n.Path.Value)-1])
-			packType = LOCAL_PACKAGE
+			v.scanned.Imports = append(v.scanned.Imports,
+				scannedImport{string(n.Path.Value[3 : len(n.Path.Value)-1]), true})
 
 		} else {
-			packName = string(n.Path.Value[1 : len(n.Path.Value)-1])
-			packType = UNKNOWN_PACKAGE
+			v.scanned.Imports = append(v.scanned.Imports,
+				scannedImport{string(n.Path.Value[1 : len(n.Path.Value)-1]), false})
 		}
 
-		dep, exists := v.packs.Get(packName)
-		if !exists {
-			dep = v.packs.AddNewPackage(packName)
-		} else if dep.Type == LOCAL_PACKAGE {
-			packType = LOCAL_PACKAGE
+		if string(n.Path.Value) == "\"C\"" {
+			v.scanned.IsCGOFile = true
 		}
 
-		dep.Type = packType
-		v.file.Pack.Depends.Push(dep)
-
-		if string(n.Path.Value) == "\"C\"" {
-			v.file.IsCGOFile = true
+		if string(n.Path.Value) == "\"testing\"" {
+			if n.Name != nil {
+				v.testingName = n.Name.String()
+			} else {
+				v.testingName = "testing"
+			}
 		}
 
 		return nil
 	case *ast.FuncDecl:
-		if n.Recv == nil && n.Name.String() == "main" && v.file.Pack.Name == "main" {
-			v.file.HasMain = true
-		} else if n.Recv == nil && v.file.IsTestFile &&
-			strings.HasPrefix(n.Name.String(), "Test") &&
-			n.Body != nil {
-			v.file.TestFunctions.Push(n.Name.String())
-		} else if n.Recv == nil && v.file.IsTestFile &&
-			strings.HasPrefix(n.Name.String(), "Benchmark") &&
-			n.Body != nil {
-			v.file.BenchmarkFunctions.Push(n.Name.String())
+		if n.Recv == nil && n.Name.String() == "main" && v.scanned.Package == "main" {
+			v.scanned.HasMain = true
+		} else if n.Recv == nil && v.isTestFile && n.Body != nil {
+			v.addTestFunction(n)
 		}
 		return nil
 	case *ast.Package, *ast.File, *ast.BadDecl,
@@ -176,3 +336,142 @@ func (v astVisitor) Visit(node ast.Node) (w ast.Visitor) {
 
 	return nil // unreachable
 }
+
+/*
+ Adds Test*, Benchmark*, Example* and Fuzz* functions of a test file to the
+ vector they belong to. Functions that have one of these prefixes but are no valid
+ test function (wrong signature, lower case letter after the prefix) are
+ skipped with a warning, they would only cause compile errors in _testmain.go.
+*/
+func (v *astVisitor) addTestFunction(fn *ast.FuncDecl) {
+	name := fn.Name.String()
+
+	switch {
+	case name == "TestMain":
+		// TestMain(m *testing.M) wraps all tests of a package and is no test
+		// function by itself. The _testmain of gobuild doesn't call it.
+		if v.hasTestingParam(fn, "M") {
+			v.warn(fn, "TestMain is not supported and won't be run, skipping it")
+		} else {
+			v.warn(fn, "TestMain should have signature func TestMain(m *testing.M), skipping it")
+		}
+	case isTestName(name, "Test"):
+		if v.hasTestingParam(fn, "T") {
+			v.scanned.TestFunctions = append(v.scanned.TestFunctions, name)
+		} else {
+			v.warn(fn, "%s should have signature func %s(t *testing.T), skipping it", name, name)
+		}
+	case isTestName(name, "Benchmark"):
+		if v.hasTestingParam(fn, "B") {
+			v.scanned.BenchmarkFunctions = append(v.scanned.BenchmarkFunctions, name)
+		} else {
+			v.warn(fn, "%s should have signature func %s(b *testing.B), skipping it", name, name)
+		}
+	case isTestName(name, "Example"):
+		if fn.Type.Params.NumFields() == 0 && fn.Type.Results.NumFields() == 0 {
+			v.scanned.ExampleFunctions = append(v.scanned.ExampleFunctions, v.newExample(fn))
+		} else {
+			v.warn(fn, "%s should have signature func %s(), skipping it", name, name)
+		}
+	case isTestName(name, "Fuzz"):
+		if hasByteSliceParam(fn) {
+			v.scanned.FuzzFunctions = append(v.scanned.FuzzFunctions, name)
+		} else {
+			v.warn(fn, "%s should have signature func %s(data []byte), skipping it", name, name)
+		}
+	case strings.HasPrefix(name, "Test") || strings.HasPrefix(name, "Benchmark") ||
+		strings.HasPrefix(name, "Example") || strings.HasPrefix(name, "Fuzz"):
+		v.warn(fn, "%s is no test function (lower case letter after prefix), skipping it", name)
+	}
+}
+
+/*
+ Returns true if the function has exactly one parameter of type
+ *testing.<typeName> and no results.
+*/
+func (v *astVisitor) hasTestingParam(fn *ast.FuncDecl, typeName string) bool {
+	if fn.Type.Params.NumFields() != 1 || fn.Type.Results.NumFields() != 0 {
+		return false
+	}
+
+	star, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+
+	// import . "testing"
+	if ident, ok := star.X.(*ast.Ident); ok {
+		return v.testingName == "." && ident.Name == typeName
+	}
+
+	sel, ok := star.X.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pack, ok := sel.X.(*ast.Ident)
+	return ok && pack.Name == v.testingName && sel.Sel.Name == typeName
+}
+
+/*
+ Returns true if the function has exactly one parameter of type []byte and
+ no results. Fuzz functions report errors by panicking.
+*/
+func hasByteSliceParam(fn *ast.FuncDecl) bool {
+	if fn.Type.Params.NumFields() != 1 || fn.Type.Results.NumFields() != 0 {
+		return false
+	}
+
+	array, ok := fn.Type.Params.List[0].Type.(*ast.ArrayType)
+	if !ok || array.Len != nil {
+		return false
+	}
+	elt, ok := array.Elt.(*ast.Ident)
+	return ok && elt.Name == "byte"
+}
+
+/*
+ Prints a warning with file name and line of a function.
+*/
+func (v *astVisitor) warn(fn *ast.FuncDecl, format string, args ...interface{}) {
+	pos := v.fset.Position(fn.Pos())
+	v.scanned.warn("%s:%d: "+format+"\n", append([]interface{}{pos.Filename, pos.Line}, args...)...)
+}
+
+/*
+ Returns true if name is prefix followed by nothing or something that doesn't
+ start with a lower case letter, e.g. Test and TestFoo but not Testify.
+*/
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	rune, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(rune)
+}
+
+/*
+ Creates an Example for an Example* function. The last comment inside
+ the function body is used as expected output if it starts with "Output:".
+*/
+func (v *astVisitor) newExample(fn *ast.FuncDecl) *Example {
+	example := &Example{Name: fn.Name.String()}
+
+	var lastComment *ast.CommentGroup
+	for _, cg := range v.comments {
+		if cg.Pos() > fn.Body.Lbrace && cg.End() < fn.Body.Rbrace {
+			lastComment = cg
+		}
+	}
+	if lastComment != nil {
+		text := strings.TrimSpace(doc.CommentText(lastComment))
+		if strings.HasPrefix(text, "Output:") {
+			example.Output = strings.TrimSpace(text[len("Output:"):])
+			example.HasOutput = true
+		}
+	}
+
+	return example
+}
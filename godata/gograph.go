@@ -0,0 +1,341 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ The import graph of the packages in a GoPackageContainer. Packages are the
+ nodes, the Depends of a package are its edges. All functions return the
+ packages in a deterministic order: sorted by name (main packages by their
+ output file) unless the order itself is the result (TopologicalOrder).
+*/
+package godata
+
+import "os"
+import "sort"
+import "strings"
+
+// ================================
+// ======== sorted packages =======
+// ================================
+
+// implementation of sort.Interface: by name, main packages by output file
+// and then by their first file (package main and main.go have the same
+// output file, so do all main packages with -o)
+type packageSlice []*GoPackage
+
+func (this packageSlice) Len() int      { return len(this) }
+func (this packageSlice) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this packageSlice) Less(i, j int) bool {
+	if this[i].Name != this[j].Name {
+		return this[i].Name < this[j].Name
+	}
+	if this[i].OutputFile != this[j].OutputFile {
+		return this[i].OutputFile < this[j].OutputFile
+	}
+	return getFirstFilename(this[i]) < getFirstFilename(this[j])
+}
+
+/*
+ Returns the smallest file name of a package, "" if it has no files.
+*/
+func getFirstFilename(pack *GoPackage) (first string) {
+	for _, igf := range *pack.Files {
+		if filename := igf.(*GoFile).Filename; first == "" || filename < first {
+			first = filename
+		}
+	}
+	return
+}
+
+/*
+ Sorts packages in place and returns them.
+*/
+func sortPackages(packs []*GoPackage) []*GoPackage {
+	sort.Sort(packageSlice(packs))
+	return packs
+}
+
+// ================================
+// ============ graph =============
+// ================================
+
+/*
+ Returns all packages, including the package of every file with a main
+ function (unmerged, see GetMainPackages).
+*/
+func (this *GoPackageContainer) GetPackages() []*GoPackage {
+	packs := make([]*GoPackage, 0, len(this.packages)+len(this.mains))
+	for _, pack := range this.packages {
+		packs = append(packs, pack)
+	}
+	for _, pack := range this.mains {
+		packs = append(packs, pack)
+	}
+	return sortPackages(packs)
+}
+
+/*
+ Returns the packages a package imports. If transitive is true the
+ packages they import are included, and so on. The package itself is never
+ part of the result (unless it's part of a cycle and transitive is true).
+*/
+func (this *GoPackageContainer) Dependencies(pack *GoPackage, transitive bool) []*GoPackage {
+	return walkEdges(pack, transitive, func(p *GoPackage) (next []*GoPackage) {
+		for _, idep := range *p.Depends {
+			next = append(next, idep.(*GoPackage))
+		}
+		return
+	})
+}
+
+/*
+ Returns the packages that import a package. If transitive is true the
+ packages that import them are included, and so on.
+*/
+func (this *GoPackageContainer) Dependents(pack *GoPackage, transitive bool) []*GoPackage {
+	dependents := this.getDependentsMap()
+	return walkEdges(pack, transitive, func(p *GoPackage) []*GoPackage {
+		return dependents[p]
+	})
+}
+
+/*
+ Returns reverse edges for all packages: package -> packages that import it.
+*/
+func (this *GoPackageContainer) getDependentsMap() map[*GoPackage][]*GoPackage {
+	dependents := make(map[*GoPackage][]*GoPackage)
+	for _, pack := range this.GetPackages() {
+		for _, idep := range *pack.Depends {
+			dep := idep.(*GoPackage)
+			dependents[dep] = append(dependents[dep], pack)
+		}
+	}
+	return dependents
+}
+
+/*
+ Follows the edges returned by next from a package. Returns the packages
+ reached with one edge or (transitive) any number of edges, without
+ duplicates and sorted.
+*/
+func walkEdges(pack *GoPackage, transitive bool, next func(*GoPackage) []*GoPackage) []*GoPackage {
+	visited := make(map[*GoPackage]bool)
+	var result []*GoPackage
+	queue := []*GoPackage{pack}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, n := range next(p) {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			result = append(result, n)
+			if transitive {
+				queue = append(queue, n)
+			}
+		}
+	}
+	return sortPackages(result)
+}
+
+/*
+ Returns all packages so that every package comes after the packages it
+ imports, i.e. in the order they can be compiled. Packages without order
+ between them are sorted by name. If there are import cycles the order is
+ still complete but an error is returned (see Cycles).
+*/
+func (this *GoPackageContainer) TopologicalOrder() (order []*GoPackage, err os.Error) {
+	visited := make(map[*GoPackage]bool)
+	var visit func(pack *GoPackage)
+	visit = func(pack *GoPackage) {
+		if visited[pack] {
+			return
+		}
+		visited[pack] = true
+		for _, dep := range this.Dependencies(pack, false) {
+			visit(dep)
+		}
+		order = append(order, pack)
+	}
+
+	for _, pack := range this.GetPackages() {
+		visit(pack)
+	}
+
+	if cycles := this.Cycles(); len(cycles) > 0 {
+		var names []string
+		for _, pack := range cycles[0] {
+			names = append(names, pack.Name)
+		}
+		err = os.NewError("import cycle: " + strings.Join(names, " -> ") + " -> " + names[0])
+	}
+	return
+}
+
+/*
+ Calls fn for all packages in topological order (see TopologicalOrder),
+ until fn returns false.
+*/
+func (this *GoPackageContainer) Walk(fn func(pack *GoPackage) bool) {
+	order, _ := this.TopologicalOrder()
+	for _, pack := range order {
+		if !fn(pack) {
+			return
+		}
+	}
+}
+
+/*
+ Returns a new container with the roots and all packages they import,
+ directly or indirectly. The packages are the same, not copies. Main
+ packages among them stay main packages, including the merged ones returned
+ by GetMain and GetMainPackages.
+*/
+func (this *GoPackageContainer) Subgraph(roots []*GoPackage) *GoPackageContainer {
+	sub := NewGoPackageContainer()
+
+	isMain := make(map[*GoPackage]string)
+	for filename, pack := range this.mains {
+		isMain[pack] = filename
+	}
+
+	add := func(pack *GoPackage) {
+		if filename, exists := isMain[pack]; exists {
+			sub.mains[filename] = pack
+			return
+		}
+		// a merged main package is a copy, it's found by its main file
+		if pack.Name == "main" {
+			for _, igf := range *pack.Files {
+				if gf := igf.(*GoFile); gf.HasMain {
+					sub.mains[gf.Filename] = pack
+					return
+				}
+			}
+		}
+		sub.packages[pack.Name] = pack
+	}
+	for _, root := range roots {
+		add(root)
+		for _, dep := range this.Dependencies(root, true) {
+			add(dep)
+		}
+	}
+	return sub
+}
+
+/*
+ Returns the import cycles, one for every group of packages that import
+ each other. Every cycle is a list of packages in which each package
+ imports the next one and the last one imports the first one. It starts with
+ the package with the smallest name of its group (see orderCycle), cycles
+ are sorted by it.
+*/
+func (this *GoPackageContainer) Cycles() (cycles [][]*GoPackage) {
+	// Tarjan's algorithm for strongly connected components
+	var index int
+	var stack []*GoPackage
+	indices := make(map[*GoPackage]int)
+	lowlinks := make(map[*GoPackage]int)
+	onStack := make(map[*GoPackage]bool)
+
+	var connect func(pack *GoPackage)
+	connect = func(pack *GoPackage) {
+		indices[pack] = index
+		lowlinks[pack] = index
+		index++
+		stack = append(stack, pack)
+		onStack[pack] = true
+
+		for _, dep := range this.Dependencies(pack, false) {
+			if _, visited := indices[dep]; !visited {
+				connect(dep)
+				if lowlinks[dep] < lowlinks[pack] {
+					lowlinks[pack] = lowlinks[dep]
+				}
+			} else if onStack[dep] && indices[dep] < lowlinks[pack] {
+				lowlinks[pack] = indices[dep]
+			}
+		}
+
+		if lowlinks[pack] != indices[pack] {
+			return
+		}
+		var component []*GoPackage
+		for {
+			p := stack[len(stack)-1]
+			stack = stack[0 : len(stack)-1]
+			onStack[p] = false
+			component = append(component, p)
+			if p == pack {
+				break
+			}
+		}
+		if len(component) > 1 || importsItself(pack) {
+			cycles = append(cycles, this.orderCycle(sortPackages(component)))
+		}
+	}
+
+	for _, pack := range this.GetPackages() {
+		if _, visited := indices[pack]; !visited {
+			connect(pack)
+		}
+	}
+
+	sort.Sort(cycleSlice(cycles))
+	return
+}
+
+func importsItself(pack *GoPackage) bool {
+	for _, idep := range *pack.Depends {
+		if idep.(*GoPackage) == pack {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Returns the shortest cycle through the first package of a strongly
+ connected component (sorted), starting with that package. Imports are
+ followed in sorted order, so the cycle is always the same.
+*/
+func (this *GoPackageContainer) orderCycle(component []*GoPackage) []*GoPackage {
+	inComponent := make(map[*GoPackage]bool)
+	for _, pack := range component {
+		inComponent[pack] = true
+	}
+
+	first := component[0]
+	previous := map[*GoPackage]*GoPackage{first: nil}
+	queue := []*GoPackage{first}
+	for len(queue) > 0 {
+		pack := queue[0]
+		queue = queue[1:]
+		for _, dep := range this.Dependencies(pack, false) {
+			if dep == first {
+				// back at the start: the path to pack is the cycle
+				var cycle []*GoPackage
+				for p := pack; p != nil; p = previous[p] {
+					cycle = append([]*GoPackage{p}, cycle...)
+				}
+				return cycle
+			}
+			if _, visited := previous[dep]; !visited && inComponent[dep] {
+				previous[dep] = pack
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return component // unreachable for a strongly connected component
+}
+
+// implementation of sort.Interface: by the first package of the cycles
+type cycleSlice [][]*GoPackage
+
+func (this cycleSlice) Len() int      { return len(this) }
+func (this cycleSlice) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this cycleSlice) Less(i, j int) bool {
+	return packageSlice([]*GoPackage{this[i][0], this[j][0]}).Less(0, 1)
+}
@@ -0,0 +1,135 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package godata
+
+import "strings"
+import "testing"
+
+/*
+ Creates a container with a package for every entry of deps, which imports
+ the packages listed for it (separated by spaces).
+*/
+func newTestGraph(deps map[string]string) *GoPackageContainer {
+	packs := NewGoPackageContainer()
+	for name, _ := range deps {
+		packs.AddNewPackage(name)
+	}
+	for name, imports := range deps {
+		pack, _ := packs.Get(name)
+		for _, imp := range strings.Fields(imports) {
+			dep, _ := packs.Get(imp)
+			pack.Depends.Push(dep)
+		}
+	}
+	return packs
+}
+
+/*
+ Adds a file of package main, with or without main function.
+*/
+func addTestMainFile(packs *GoPackageContainer, filename string, hasMain bool) {
+	gf := &GoFile{Filename: filename, HasMain: hasMain, Pack: NewGoPackage("main")}
+	packs.AddFile(gf, "main")
+}
+
+// the names of packages, main packages by their main file (their first file
+// if none has a main function)
+func getTestNames(packs []*GoPackage) string {
+	names := make([]string, len(packs))
+	for i, pack := range packs {
+		names[i] = pack.Name
+		if pack.Name == "main" {
+			names[i] = getFirstFilename(pack)
+			for _, igf := range *pack.Files {
+				if igf.(*GoFile).HasMain {
+					names[i] = igf.(*GoFile).Filename
+				}
+			}
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestDependencies(t *testing.T) {
+	packs := newTestGraph(map[string]string{"a": "b", "b": "c d", "c": "", "d": "c"})
+	a, _ := packs.Get("a")
+	c, _ := packs.Get("c")
+
+	if names := getTestNames(packs.Dependencies(a, false)); names != "b" {
+		t.Errorf("direct dependencies of a: got %q, want \"b\"", names)
+	}
+	if names := getTestNames(packs.Dependencies(a, true)); names != "b c d" {
+		t.Errorf("dependencies of a: got %q, want \"b c d\"", names)
+	}
+	if names := getTestNames(packs.Dependents(c, false)); names != "b d" {
+		t.Errorf("direct dependents of c: got %q, want \"b d\"", names)
+	}
+	if names := getTestNames(packs.Dependents(c, true)); names != "a b d" {
+		t.Errorf("dependents of c: got %q, want \"a b d\"", names)
+	}
+}
+
+func TestTopologicalOrder(t *testing.T) {
+	packs := newTestGraph(map[string]string{"a": "d", "b": "", "c": "a b", "d": ""})
+
+	order, err := packs.TopologicalOrder()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if names := getTestNames(order); names != "d a b c" {
+		t.Errorf("got %q, want \"d a b c\"", names)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	packs := newTestGraph(map[string]string{"a": "b", "b": "c", "c": "a", "d": "d", "e": "a"})
+
+	cycles := packs.Cycles()
+	if len(cycles) != 2 {
+		t.Fatalf("got %d cycles, want 2", len(cycles))
+	}
+	if names := getTestNames(cycles[0]); names != "a b c" {
+		t.Errorf("first cycle: got %q, want \"a b c\"", names)
+	}
+	if names := getTestNames(cycles[1]); names != "d" {
+		t.Errorf("second cycle: got %q, want \"d\"", names)
+	}
+
+	if _, err := packs.TopologicalOrder(); err == nil {
+		t.Errorf("no error for an import cycle")
+	}
+}
+
+// package main and main.go have the same name and output file
+func TestMainOrder(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		packs := newTestGraph(map[string]string{"util": ""})
+		addTestMainFile(packs, "helper.go", false)
+		addTestMainFile(packs, "main.go", true)
+		addTestMainFile(packs, "cmd.go", true)
+
+		if names := getTestNames(packs.GetPackages()); names != "cmd.go helper.go main.go util" {
+			t.Fatalf("got %q, want \"cmd.go helper.go main.go util\"", names)
+		}
+	}
+}
+
+// a merged main package must not replace package main
+func TestSubgraphMergedMain(t *testing.T) {
+	packs := newTestGraph(map[string]string{"util": "", "other": ""})
+	addTestMainFile(packs, "helper.go", false)
+	addTestMainFile(packs, "main.go", true)
+	helpers, _ := packs.Get("main")
+	util, _ := packs.Get("util")
+	helpers.Depends.Push(util)
+
+	sub := packs.Subgraph(packs.GetMainPackages(true))
+	if names := getTestNames(sub.GetPackages()); names != "main.go util" {
+		t.Errorf("got %q, want \"main.go util\"", names)
+	}
+	if sub.GetMainCount() != 1 {
+		t.Errorf("got %d main packages, want 1", sub.GetMainCount())
+	}
+}
@@ -9,7 +9,9 @@ package godata
 
 import "container/vector"
 import "os"
-import "./logger"
+import "sort"
+import "strings"
+import "sync"
 
 
 const (
@@ -19,6 +21,9 @@ const (
 	REMOTE_PACKAGE  // unused right now
 )
 
+// suffix of external test packages (package foo_test tests package foo)
+const EXTERNAL_TEST_SUFFIX = "_test"
+
 // ================================
 // ========== GoPackage ===========
 // ================================
@@ -77,7 +82,7 @@ func (this *GoPackage) Clone() *GoPackage {
 */
 func (this *GoPackage) Merge(pack *GoPackage) {
 	if this == pack {
-		logger.Warn("Trying to merge identical packages!\n")
+		scanLog.Warn("Trying to merge identical packages!\n")
 		return // don't merge duplicates
 	}
 	pack.Files.Do(func(gf interface{}) { this.Files.Push(gf.(*GoFile)) })
@@ -102,6 +107,20 @@ func (this *GoPackage) NeedsLocalSearchPath() bool {
 	return ret
 }
 
+/*
+ Returns the files that have to be compiled for this package. _test.go files
+ are only part of the test build (testBuild = true), a library or executable
+ never contains them.
+*/
+func (this *GoPackage) GetSourceFiles(testBuild bool) (files []*GoFile) {
+	for _, e := range *this.Files {
+		if testBuild || !e.(*GoFile).IsTestFile {
+			files = append(files, e.(*GoFile))
+		}
+	}
+	return
+}
+
 /*
  Returns true if one of the files for this package contains some test functions.
 */
@@ -114,6 +133,22 @@ func (this *GoPackage) HasTestFiles() bool {
 	return false
 }
 
+/*
+ Returns true if this is an external test package (package foo_test). Those
+ only consist of _test.go files and are tested together with package foo.
+*/
+func (this *GoPackage) IsExternalTestPackage() bool {
+	if !strings.HasSuffix(this.Name, EXTERNAL_TEST_SUFFIX) || this.Files.Len() == 0 {
+		return false
+	}
+	for _, e := range *this.Files {
+		if !e.(*GoFile).IsTestFile {
+			return false
+		}
+	}
+	return true
+}
+
 /*
  Check files if one of them needs to be build with cgo. Those
  can't be compiled by gobuild right now.
@@ -130,7 +165,9 @@ func (this *GoPackage) HasCGOFiles() bool {
 
 /*
  This looks for an existing .a file for this package
- and returns true if one was found.
+ and returns true if one was found. The file is searched relative to the
+ root path, where cgo packages are built by hand, even if the compiler runs
+ in another directory (gobuild passes the root path with -I/-L then).
 */
 func (this *GoPackage) HasExistingAFile() bool {
 	_, err := os.Stat(this.OutputFile + ".a")
@@ -142,7 +179,13 @@ func (this *GoPackage) HasExistingAFile() bool {
 // ====== GoPackageContainer ======
 // ================================
 
+/*
+ All packages. Files can be added from several goroutines at the same time
+ (see GoFile.ParseFile and ParseFiles), all other methods must not be called
+ while files are added.
+*/
 type GoPackageContainer struct {
+	mutex    sync.Mutex // locked while a file is added
 	packages map[string]*GoPackage
 	mains    map[string]*GoPackage
 }
@@ -225,6 +268,18 @@ func (this *GoPackageContainer) Get(name string) (pack *GoPackage, exists bool)
 	return
 }
 
+/*
+ Returns the external test package (package foo_test) for the package with the
+ given name, or (nil, false) if there is none.
+*/
+func (this *GoPackageContainer) GetExternalTestPackage(name string) (pack *GoPackage, exists bool) {
+	pack, exists = this.packages[name+EXTERNAL_TEST_SUFFIX]
+	if exists && !pack.IsExternalTestPackage() {
+		return nil, false
+	}
+	return
+}
+
 /*
  Will return the main package for a certain filename. That file must include
  a main function. If "merge" is true the returned package is a merge of the
@@ -267,7 +322,7 @@ func (this *GoPackageContainer) GetMainCount() int {
 }
 
 /*
-
+ Returns the names of all files with a main function, sorted.
 */
 func (this *GoPackageContainer) GetMainFilenames() (names []string) {
 	names = make([]string, this.GetMainCount())
@@ -276,6 +331,7 @@ func (this *GoPackageContainer) GetMainFilenames() (names []string) {
 		names[i] = fn
 		i++
 	}
+	sort.SortStrings(names)
 
 	return
 }
@@ -286,23 +342,24 @@ func (this *GoPackageContainer) GetMainFilenames() (names []string) {
  files of the main package that don't have a main function in it.
  The returned packages may be copies of the one inside the container. Writing to
  them might not change values in the original packages.
+ The packages are in the order of their file names (see GetMainFilenames).
 */
 func (this *GoPackageContainer) GetMainPackages(merge bool) (pack []*GoPackage) {
 	pack = make([]*GoPackage, this.GetMainCount())
 	mainPack, mainExists := this.packages["main"]
-	var i int
-	for _, p := range this.mains {
-		pack[i] = p
+	for i, fn := range this.GetMainFilenames() {
+		pack[i] = this.mains[fn]
 		if merge && mainExists {
 			pack[i] = pack[i].Clone()
 			pack[i].Merge(mainPack)
 		}
-
-		i++
 	}
 	return
 }
 
+/*
+ Returns the names of all packages, sorted.
+*/
 func (this *GoPackageContainer) GetPackageNames() (packNames []string) {
 	var i int
 	packNames = make([]string, len(this.packages))
@@ -310,6 +367,7 @@ func (this *GoPackageContainer) GetPackageNames() (packNames []string) {
 		packNames[i] = name
 		i++
 	}
+	sort.SortStrings(packNames)
 	return
 }
 
@@ -0,0 +1,168 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Selecting the packages whose tests are affected by changed files
+ (-changed, -since).
+*/
+package main
+
+import (
+	"os"
+	"exec"
+	"flag"
+	"io/ioutil"
+	path "path/filepath"
+	"strings"
+	"./godata"
+)
+
+/*
+ Returns the files given with -changed or changed since the -since revision,
+ relative to the root path.
+*/
+func getChangedFiles() (files []string) {
+	if *flagChanged {
+		for _, filename := range flag.Args() {
+			files = append(files, path.Clean(filename))
+		}
+	}
+
+	if *flagSince != "" {
+		gitBin, err := exec.LookPath("git")
+		if err != nil {
+			testLog.Error("Need git for -since: %s\n", err)
+			os.Exit(1)
+		}
+
+		// --relative: only files below the root path, relative to it
+		argv := []string{gitBin, "diff", "--name-only", "--relative", *flagSince}
+		testLog.Debug("%s\n", getCommandline(argv))
+		cmd, err := exec.Run(gitBin, argv, os.Environ(), rootPath,
+			exec.DevNull, exec.Pipe, exec.PassThrough)
+		if err != nil {
+			testLog.Error("%s\n", err)
+			os.Exit(1)
+		}
+		output, _ := ioutil.ReadAll(cmd.Stdout)
+		waitmsg, err := cmd.Wait(0)
+		if err != nil || waitmsg.ExitStatus() != 0 {
+			testLog.Error("Could not get the files changed since %s.\n", *flagSince)
+			os.Exit(1)
+		}
+
+		// git diff doesn't know new files that aren't added yet
+		untracked, ok := runGit("ls-files", "--others", "--exclude-standard")
+		if !ok {
+			testLog.Error("Could not get the untracked files.\n")
+			os.Exit(1)
+		}
+		output = append(output, untracked...)
+
+		for _, filename := range strings.Split(string(output), "\n", -1) {
+			if filename = strings.TrimSpace(filename); filename != "" {
+				files = append(files, filename)
+			}
+		}
+	}
+	return
+}
+
+/*
+ Returns the package a changed file belongs to, or nil if it doesn't belong
+ to any. Go files are looked up directly (main files belong to their own
+ main package), other files (e.g. deleted files) belong to the first
+ package with files in the same directory. Files below a testdata directory
+ belong to the package in the directory that contains testdata.
+*/
+func getChangedPackage(filename string) *godata.GoPackage {
+	dir, _ := path.Split(filename)
+	parts := strings.Split(dir, "/", -1)
+	for i, part := range parts {
+		if part == "testdata" {
+			dir = strings.Join(parts[0:i], "/")
+			if dir != "" {
+				dir += "/"
+			}
+			break
+		}
+	}
+
+	var sameDir *godata.GoPackage
+	for _, pack := range goPackages.GetPackages() {
+		for _, igf := range *pack.Files {
+			gf := igf.(*godata.GoFile)
+			if gf.Filename == filename {
+				return pack
+			}
+			if gfDir, _ := path.Split(gf.Filename); gfDir == dir && sameDir == nil {
+				sameDir = pack
+			}
+		}
+	}
+	return sameDir
+}
+
+/*
+ Returns the packages whose tests have to be run for -changed/-since: the
+ packages with changed files and all packages that depend on them, directly
+ or indirectly. Prints every selected package and why it was selected.
+ Returns nil if neither option is used.
+*/
+func getAffectedPackages() map[*godata.GoPackage]bool {
+	if !*flagChanged && *flagSince == "" {
+		return nil
+	}
+
+	reasons := make(map[*godata.GoPackage]string)
+	var queue []*godata.GoPackage
+	for _, filename := range getChangedFiles() {
+		pack := getChangedPackage(filename)
+		if pack == nil {
+			testLog.Debug("Changed file %s belongs to no package.\n", filename)
+			continue
+		}
+		if _, exists := reasons[pack]; !exists {
+			reasons[pack] = "changed " + filename
+			queue = append(queue, pack)
+		}
+	}
+
+	// breadth first, so the reason is always the shortest import chain
+	for len(queue) > 0 {
+		pack := queue[0]
+		queue = queue[1:]
+		for _, dependent := range goPackages.Dependents(pack, false) {
+			if _, exists := reasons[dependent]; !exists {
+				reasons[dependent] = "imports " + pack.Name
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	// external test packages are tested together with their package
+	affected := make(map[*godata.GoPackage]bool)
+	for pack, _ := range reasons {
+		affected[pack] = true
+		if pack.IsExternalTestPackage() {
+			if basePack, exists := goPackages.Get(pack.Name[0 : len(pack.Name)-len(godata.EXTERNAL_TEST_SUFFIX)]); exists {
+				affected[basePack] = true
+			}
+		}
+	}
+
+	// main packages are printed with their main file
+	names := make(map[string]bool)
+	packsByName := make(map[string]*godata.GoPackage)
+	for pack, _ := range reasons {
+		names[getQueryName(pack)] = true
+		packsByName[getQueryName(pack)] = pack
+	}
+	testLog.Info("Packages affected by the changes:\n")
+	for _, name := range getSortedKeys(names) {
+		testLog.Info("    %s (%s)\n", name, reasons[packsByName[name]])
+	}
+
+	return affected
+}
@@ -4,11 +4,18 @@
 
 /*
  A collection of helper functions for console output.
+ Messages belong to a component (e.g. "compile" or "test", see Get) and are
+ written to all sinks (see sink.go), by default only the terminal.
 */
 package logger
 
-import "fmt"
-import "os"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
 
 const (
 	DEBUG   = -1 + iota // start with -1
@@ -19,20 +26,193 @@ const (
 
 var verbosity int
 
+// levels of single components, override verbosity
+var componentLevels = make(map[string]int)
+
+// loggers returned by Get
+var loggers = make(map[string]*componentLogger)
+
 /*
  Sets the verbosity level. Possible values are DEBUG, DEFAULT, WARN and ERROR.
  DEFAULT is the standard value which will print everything but debug messages.
 */
 func SetVerbosityLevel(level int) { verbosity = level }
 
+/*
+ Sets the verbosity level of a single component, independent of the one
+ set with SetVerbosityLevel.
+*/
+func SetComponentLevel(component string, level int) { componentLevels[component] = level }
+
+/*
+ Returns the level for a name: "debug", "info" (DEFAULT), "warn" or "error".
+*/
+func ParseLevel(name string) (level int, err os.Error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DEBUG, nil
+	case "info", "default":
+		return DEFAULT, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	}
+	return 0, os.NewError("unknown log level " + name)
+}
+
+/*
+ Sets the levels of components from a list like "compile=warn,test=debug".
+*/
+func SetComponentLevels(levels string) os.Error {
+	for _, entry := range strings.Split(levels, ",", -1) {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		idx := strings.Index(entry, "=")
+		if idx < 0 {
+			return os.NewError("expected component=level instead of " + entry)
+		}
+		level, err := ParseLevel(entry[idx+1:])
+		if err != nil {
+			return err
+		}
+		SetComponentLevel(entry[0:idx], level)
+	}
+	return nil
+}
+
+// sinks are written by one goroutine at a time
+var writeMutex sync.Mutex
+
+/*
+ Writes a record to all sinks, above the status area if one is shown (see
+ progress.go).
+*/
+func write(record *Record) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	if progress != nil {
+		progress.clear()
+	}
+	for _, sink := range sinks {
+		sink.Write(record)
+	}
+	if progress != nil {
+		progress.draw()
+	}
+}
+
+// ========== Logger ==========
+
+/*
+ The functions to print messages of a component. Same syntax as fmt.Printf.
+ The *Continue functions print further lines of a message without prefix.
+*/
+type Logger interface {
+	Debug(format string, v ...interface{})
+	DebugContinue(format string, v ...interface{})
+	Info(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	WarnContinue(format string, v ...interface{})
+	Error(format string, v ...interface{})
+	ErrorContinue(format string, v ...interface{})
+}
+
+// Logger of a component
+type componentLogger struct {
+	component string
+}
+
+/*
+ Returns the logger of a component. The component is part of every message
+ written by it and can have its own level (see SetComponentLevel).
+*/
+func Get(component string) Logger {
+	if l, exists := loggers[component]; exists {
+		return l
+	}
+	l := &componentLogger{component}
+	loggers[component] = l
+	return l
+}
+
+/*
+ Returns true if messages of the level are written.
+*/
+func (this *componentLogger) enabled(level int) bool {
+	minLevel := verbosity
+	if componentLevel, exists := componentLevels[this.component]; exists {
+		minLevel = componentLevel
+	}
+	return level >= minLevel
+}
+
+func (this *componentLogger) log(level int, cont bool, format string, v []interface{}) {
+	if !this.enabled(level) {
+		return
+	}
+
+	write(&Record{time.Nanoseconds(), level, this.component, "", fmt.Sprintf(format, v...), cont})
+}
+
+func (this *componentLogger) Debug(format string, v ...interface{}) {
+	this.log(DEBUG, false, format, v)
+}
+
+func (this *componentLogger) DebugContinue(format string, v ...interface{}) {
+	this.log(DEBUG, true, format, v)
+}
+
+func (this *componentLogger) Info(format string, v ...interface{}) {
+	this.log(DEFAULT, false, format, v)
+}
+
+func (this *componentLogger) Warn(format string, v ...interface{}) {
+	this.log(WARN, false, format, v)
+}
+
+func (this *componentLogger) WarnContinue(format string, v ...interface{}) {
+	this.log(WARN, true, format, v)
+}
+
+func (this *componentLogger) Error(format string, v ...interface{}) {
+	this.log(ERROR, false, format, v)
+}
+
+func (this *componentLogger) ErrorContinue(format string, v ...interface{}) {
+	this.log(ERROR, true, format, v)
+}
+
+// ========== default component ==========
+
+/*
+ Prints a message to stdout regardless of the verbosity and the sinks, e.g.
+ the commands printed by gobuild -x, which must not be mixed with other
+ messages (see NewStderrSink). Same syntax as fmt.Printf.
+*/
+func Print(format string, v ...interface{}) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	if progress != nil {
+		progress.clear()
+	}
+	fmt.Fprintf(os.Stdout, format, v...)
+	if progress != nil {
+		progress.draw()
+	}
+}
+
+// messages that don't belong to a component
+var defaultLogger = Get("gobuild")
+
 /*
  Prints debug messages. Same syntax as fmt.Printf.
 */
 func Debug(format string, v ...interface{}) {
-	if verbosity <= DEBUG {
-		fmt.Printf("DEBUG: ")
-		fmt.Printf(format, v...)
-	}
+	defaultLogger.Debug(format, v...)
 }
 
 /*
@@ -40,10 +220,7 @@ func Debug(format string, v ...interface{}) {
  Same syntax as fmt.Printf.
 */
 func DebugContinue(format string, v ...interface{}) {
-	if verbosity <= DEBUG {
-		fmt.Printf("       ")
-		fmt.Printf(format, v...)
-	}
+	defaultLogger.DebugContinue(format, v...)
 }
 
 /*
@@ -51,20 +228,14 @@ func DebugContinue(format string, v ...interface{}) {
  gobuild is currently doing. Same syntax as fmt.Printf.
 */
 func Info(format string, v ...interface{}) {
-	if verbosity <= DEFAULT {
-		fmt.Printf(format, v...)
-	}
+	defaultLogger.Info(format, v...)
 }
 
-
 /*
  Prints a warning if warnings are enabled. Same syntax as fmt.Printf.
 */
 func Warn(format string, v ...interface{}) {
-	if verbosity <= WARN {
-		fmt.Print("WARNING: ")
-		fmt.Printf(format, v...)
-	}
+	defaultLogger.Warn(format, v...)
 }
 
 /*
@@ -72,20 +243,14 @@ func Warn(format string, v ...interface{}) {
  Same syntax as fmt.Printf.
 */
 func WarnContinue(format string, v ...interface{}) {
-	if verbosity <= WARN {
-		fmt.Print("         ")
-		fmt.Printf(format, v...)
-	}
+	defaultLogger.WarnContinue(format, v...)
 }
 
 /*
  Prints an error message. Same syntax as fmt.Printf.
 */
 func Error(format string, v ...interface{}) {
-	if verbosity <= ERROR {
-		fmt.Fprint(os.Stderr, "ERROR: ")
-		fmt.Fprintf(os.Stderr, format, v...)
-	}
+	defaultLogger.Error(format, v...)
 }
 
 /*
@@ -93,8 +258,5 @@ func Error(format string, v ...interface{}) {
  Same syntax as fmt.Printf.
 */
 func ErrorContinue(format string, v ...interface{}) {
-	if verbosity <= ERROR {
-		fmt.Fprint(os.Stderr, "       ")
-		fmt.Fprintf(os.Stderr, format, v...)
-	}
+	defaultLogger.ErrorContinue(format, v...)
 }
@@ -0,0 +1,185 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ A live status area at the bottom of the terminal with the number of built
+ packages, the running tasks and the elapsed time. Messages are written
+ above it. Without a terminal nothing is shown, only the normal messages.
+*/
+package logger
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ioctl request for the terminal attributes (Linux), fails if the file
+// isn't a terminal
+const TCGETS = 0x5401
+
+/*
+ Returns true if stdout is a terminal that can show the status area.
+*/
+func IsTerminal() bool {
+	if os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	var termios [64]byte // larger than struct termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(os.Stdout.Fd()), TCGETS,
+		uintptr(unsafe.Pointer(&termios[0])))
+	return errno == 0
+}
+
+// the status area, nil if none is shown
+type progressState struct {
+	total   int
+	done    int
+	failed  int
+	running []string
+	start   int64 // in ns
+	lines   int   // number of lines currently shown
+	stop    chan bool
+}
+
+var progress *progressState
+
+/*
+ Shows the status area for a build of total packages if stdout is a
+ terminal the normal text output goes to and info messages are enabled.
+ It's updated once a second until FinishProgress is called.
+*/
+func StartProgress(total int) {
+	if progress != nil || !IsTerminal() || !hasTerminalTextSink() || !defaultLogger.(*componentLogger).enabled(DEFAULT) {
+		return
+	}
+
+	state := &progressState{total: total, start: time.Nanoseconds(), stop: make(chan bool)}
+	writeMutex.Lock()
+	progress = state
+	progress.draw()
+	writeMutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(1e9)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				writeMutex.Lock()
+				state.clear()
+				state.draw()
+				writeMutex.Unlock()
+			case <-state.stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+ Adds a running task (e.g. "compiling fmt") to the status area.
+*/
+func ProgressBegin(name string) {
+	if progress == nil {
+		return
+	}
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	progress.clear()
+	progress.running = append(progress.running, name)
+	progress.draw()
+}
+
+/*
+ Removes a running task from the status area. If packageDone is true a
+ package is finished, ok tells whether it was built without errors.
+*/
+func ProgressEnd(name string, packageDone, ok bool) {
+	if progress == nil {
+		return
+	}
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	progress.clear()
+	for i, running := range progress.running {
+		if running == name {
+			progress.running = append(progress.running[0:i], progress.running[i+1:]...)
+			break
+		}
+	}
+	if packageDone {
+		progress.done++
+		if !ok {
+			progress.failed++
+		}
+	}
+	progress.draw()
+}
+
+/*
+ Removes the status area and prints a summary line instead.
+*/
+func FinishProgress() {
+	if progress == nil {
+		return
+	}
+	state := progress
+	state.stop <- true
+
+	writeMutex.Lock()
+	state.clear()
+	progress = nil
+	writeMutex.Unlock()
+
+	Info("Built %d of %d package(s) in %.1fs, %d failed.\n", state.done-state.failed, state.total,
+		float64(time.Nanoseconds()-state.start)/1e9, state.failed)
+}
+
+/*
+ Returns true if a sink writes the text format to stdout.
+*/
+func hasTerminalTextSink() bool {
+	for _, sink := range sinks {
+		if _, isText := sink.Formatter.(*TextFormatter); isText && sink.Writer == os.Stdout {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Writes the status area below the cursor, which stays at its end.
+ Has to be called with writeMutex locked.
+*/
+func (this *progressState) draw() {
+	lines := []string{fmt.Sprintf("[%d/%d packages] %.0fs", this.done, this.total,
+		float64(time.Nanoseconds()-this.start)/1e9)}
+	if this.failed > 0 {
+		lines[0] += fmt.Sprintf(", %d failed", this.failed)
+	}
+	for _, name := range this.running {
+		lines = append(lines, "    "+name+"...")
+	}
+	os.Stdout.WriteString(strings.Join(lines, "\n"))
+	this.lines = len(lines)
+}
+
+/*
+ Removes the status area, the cursor is at the start of its first line
+ afterwards. Has to be called with writeMutex locked.
+*/
+func (this *progressState) clear() {
+	if this.lines == 0 {
+		return
+	}
+	// clear the line, then move up and clear the line for all others
+	os.Stdout.WriteString("\r\033[K" + strings.Repeat("\033[A\033[K", this.lines-1))
+	this.lines = 0
+}
@@ -0,0 +1,184 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Sinks the messages are written to and the formats they are written in.
+*/
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"json"
+	"os"
+	"strings"
+	"time"
+)
+
+// a single message
+type Record struct {
+	Time      int64  // in ns
+	Level     int    // DEBUG, DEFAULT, WARN or ERROR
+	Component string // see Get
+	Task      string // name of the task for the output of tasks (see Task)
+	Message   string // formatted message, usually with a trailing newline
+	Continue  bool   // true = further line of the previous message
+}
+
+var levelNames = map[int]string{DEBUG: "debug", DEFAULT: "info", WARN: "warn", ERROR: "error"}
+
+// ========== formatters ==========
+
+/*
+ Turns a record into the bytes written to a sink.
+*/
+type Formatter interface {
+	Format(record *Record) []byte
+}
+
+/*
+ The classic gobuild output: "WARNING: " and "ERROR: " in front of warnings
+ and errors, continued lines are indented. The output of tasks is written
+ as it is. With Timestamps every message starts with date, time and
+ component.
+*/
+type TextFormatter struct {
+	Timestamps bool
+}
+
+var textPrefixes = map[int]string{DEBUG: "DEBUG: ", DEFAULT: "", WARN: "WARNING: ", ERROR: "ERROR: "}
+
+func (this *TextFormatter) Format(record *Record) []byte {
+	var buf bytes.Buffer
+
+	if this.Timestamps {
+		fmt.Fprintf(&buf, "%s [%s] ", formatTime(record.Time, "2006-01-02 15:04:05"), record.Component)
+	}
+
+	prefix := textPrefixes[record.Level]
+	if record.Task != "" {
+		prefix = ""
+	} else if record.Continue {
+		prefix = strings.Repeat(" ", len(prefix))
+	}
+	buf.WriteString(prefix)
+	buf.WriteString(record.Message)
+	return buf.Bytes()
+}
+
+/*
+ One JSON object per message and line with the fields Time (RFC 3339),
+ Level, Component, Task, Message and Continue. Messages don't have a trailing
+ newline.
+*/
+type JSONFormatter struct{}
+
+// a record as written by JSONFormatter
+type jsonRecord struct {
+	Time      string
+	Level     string
+	Component string
+	Task      string
+	Message   string
+	Continue  bool
+}
+
+func (this *JSONFormatter) Format(record *Record) []byte {
+	data, err := json.Marshal(&jsonRecord{
+		formatTime(record.Time, time.RFC3339),
+		levelNames[record.Level],
+		record.Component,
+		record.Task,
+		strings.TrimRight(record.Message, "\n"),
+		record.Continue,
+	})
+	if err != nil {
+		return nil
+	}
+	return append(data, '\n')
+}
+
+/*
+ Returns a formatter by name: "text" or "json".
+*/
+func NewFormatter(name string, timestamps bool) (Formatter, os.Error) {
+	switch name {
+	case "text":
+		return &TextFormatter{timestamps}, nil
+	case "json":
+		return &JSONFormatter{}, nil
+	}
+	return nil, os.NewError("unknown log format " + name)
+}
+
+func formatTime(ns int64, layout string) string {
+	return time.SecondsToLocalTime(ns / 1e9).Format(layout)
+}
+
+// ========== sinks ==========
+
+/*
+ Writes formatted records to a writer. Errors go to ErrWriter if it is set,
+ e.g. stderr for the terminal.
+*/
+type Sink struct {
+	Writer    io.Writer
+	ErrWriter io.Writer
+	Formatter Formatter
+}
+
+// sinks all messages are written to
+var sinks = []*Sink{NewTerminalSink(&TextFormatter{})}
+
+/*
+ Creates a sink for stdout, errors are written to stderr.
+*/
+func NewTerminalSink(formatter Formatter) *Sink {
+	return &Sink{os.Stdout, os.Stderr, formatter}
+}
+
+/*
+ Creates a sink for stderr, for when stdout is used for something else (see
+ Print).
+*/
+func NewStderrSink(formatter Formatter) *Sink {
+	return &Sink{os.Stderr, nil, formatter}
+}
+
+/*
+ Creates a sink for a writer.
+*/
+func NewWriterSink(writer io.Writer, formatter Formatter) *Sink {
+	return &Sink{writer, nil, formatter}
+}
+
+/*
+ Creates (or truncates) a file and returns a sink for it.
+*/
+func NewFileSink(filename string, formatter Formatter) (*Sink, os.Error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(file, formatter), nil
+}
+
+/*
+ Replaces all sinks.
+*/
+func SetSinks(newSinks ...*Sink) { sinks = newSinks }
+
+/*
+ Adds a sink, messages are written to all sinks.
+*/
+func AddSink(sink *Sink) { sinks = append(sinks, sink) }
+
+func (this *Sink) Write(record *Record) {
+	writer := this.Writer
+	if record.Level == ERROR && this.ErrWriter != nil {
+		writer = this.ErrWriter
+	}
+	writer.Write(this.Formatter.Format(record))
+}
@@ -0,0 +1,119 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Output of tasks like compiling a package or running its tests. Complete
+ lines are written at once, so the output of tasks running at the same time
+ never mixes within a line.
+*/
+package logger
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"time"
+)
+
+// how the output of tasks is written
+const (
+	OUTPUT_PLAIN  = iota // every line as it is
+	OUTPUT_PREFIX        // every line with "[task] " in front of it
+	OUTPUT_BLOCK         // all lines of a task at once when it's finished
+)
+
+var outputMode int = OUTPUT_PLAIN
+
+/*
+ Sets how the output of tasks is written: OUTPUT_PLAIN, OUTPUT_PREFIX or
+ OUTPUT_BLOCK.
+*/
+func SetOutputMode(mode int) { outputMode = mode }
+
+/*
+ Returns the output mode for a name: "plain", "prefix" or "block".
+*/
+func ParseOutputMode(name string) (mode int, err os.Error) {
+	switch name {
+	case "plain":
+		return OUTPUT_PLAIN, nil
+	case "prefix":
+		return OUTPUT_PREFIX, nil
+	case "block":
+		return OUTPUT_BLOCK, nil
+	}
+	return 0, os.NewError("unknown output mode " + name)
+}
+
+/*
+ The output of a single task. Implements io.Writer, Close has to be called
+ when the task is finished. Task output is written to all sinks regardless
+ of the verbosity, like the output of the compiler always was.
+*/
+type Task struct {
+	name    string
+	level   int          // DEFAULT, ERROR for the stderr of a task
+	partial []byte       // incomplete last line
+	block   bytes.Buffer // all lines in OUTPUT_BLOCK mode
+}
+
+/*
+ Creates the output of a task, the name is used as prefix.
+*/
+func NewTask(name string) *Task {
+	return &Task{name: name, level: DEFAULT}
+}
+
+/*
+ Creates the error output (stderr) of a task. It's written like errors, so
+ the terminal sink writes it to stderr.
+*/
+func NewErrorTask(name string) *Task {
+	return &Task{name: name, level: ERROR}
+}
+
+/*
+ Implementation of io.Writer.
+*/
+func (this *Task) Write(data []byte) (n int, err os.Error) {
+	this.partial = append(this.partial, data...)
+	if idx := bytes.LastIndex(this.partial, []byte{'\n'}); idx >= 0 {
+		this.writeLines(string(this.partial[0 : idx+1]))
+		this.partial = this.partial[idx+1:]
+	}
+	return len(data), nil
+}
+
+/*
+ Writes an incomplete last line and in OUTPUT_BLOCK mode all the output of
+ the task, with a "[task]" line in front of it.
+*/
+func (this *Task) Close() os.Error {
+	if len(this.partial) > 0 {
+		this.writeLines(string(this.partial) + "\n")
+		this.partial = nil
+	}
+	if this.block.Len() > 0 {
+		this.write("[" + this.name + "]\n" + this.block.String())
+		this.block.Reset()
+	}
+	return nil
+}
+
+func (this *Task) writeLines(lines string) {
+	switch outputMode {
+	case OUTPUT_PREFIX:
+		prefix := "[" + this.name + "] "
+		this.write(prefix + strings.Replace(lines[0:len(lines)-1], "\n", "\n"+prefix, -1) + "\n")
+	case OUTPUT_BLOCK:
+		this.block.WriteString(lines)
+	default:
+		this.write(lines)
+	}
+}
+
+func (this *Task) write(message string) {
+	write(&Record{Time: time.Nanoseconds(), Level: this.level, Component: "output", Task: this.name,
+		Message: message})
+}
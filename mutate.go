@@ -0,0 +1,308 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Mutation testing (-mutate): small changes are made to the source of a
+ package one at a time, each mutant should make at least one test fail.
+*/
+package main
+
+import (
+	"os"
+	"bytes"
+	"exec"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"syscall"
+	"time"
+	"./godata"
+	"./logger"
+)
+
+// minimum time the tests of a mutant may take before they are killed, in ns
+const MUTANT_MIN_TIMEOUT = 10e9
+
+// operators and what they are replaced with
+var mutatedOperators = map[token.Token]token.Token{
+	token.EQL:  token.NEQ,
+	token.NEQ:  token.EQL,
+	token.LSS:  token.GEQ,
+	token.GEQ:  token.LSS,
+	token.GTR:  token.LEQ,
+	token.LEQ:  token.GTR,
+	token.ADD:  token.SUB,
+	token.SUB:  token.ADD,
+	token.MUL:  token.QUO,
+	token.QUO:  token.MUL,
+	token.LAND: token.LOR,
+	token.LOR:  token.LAND,
+}
+
+// a single change to the AST of a file, apply and revert modify the AST in place
+type mutation struct {
+	file        *godata.GoFile
+	pos         token.Position
+	description string
+	apply       func()
+	revert      func()
+}
+
+// this visitor collects all possible mutations of a file
+type mutationVisitor struct {
+	file      *godata.GoFile
+	fset      *token.FileSet
+	mutations []*mutation
+}
+
+/*
+ Implementation of the visitor interface for ast walker.
+*/
+func (v *mutationVisitor) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		op := n.Op
+		if mutated, exists := mutatedOperators[op]; exists {
+			v.add(n.OpPos, "replaced "+op.String()+" with "+mutated.String(),
+				func() { n.Op = mutated }, func() { n.Op = op })
+		}
+	case *ast.BlockStmt:
+		v.addStatements(n.List)
+	case *ast.CaseClause:
+		v.addStatements(n.Body)
+	case *ast.CommClause:
+		v.addStatements(n.Body)
+	}
+	return v
+}
+
+func (v *mutationVisitor) add(pos token.Pos, description string, apply, revert func()) {
+	v.mutations = append(v.mutations,
+		&mutation{v.file, v.fset.Position(pos), description, apply, revert})
+}
+
+/*
+ Adds a mutation that removes the statement for every statement of a list
+ that doesn't declare anything: calls, assignments and ++/--.
+*/
+func (v *mutationVisitor) addStatements(list []ast.Stmt) {
+	for i, stmt := range list {
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			if s.Tok == token.DEFINE {
+				continue
+			}
+		case *ast.ExprStmt, *ast.IncDecStmt:
+		default:
+			continue
+		}
+
+		i, stmt := i, stmt
+		v.add(stmt.Pos(), "removed statement",
+			func() { list[i] = &ast.EmptyStmt{Semicolon: stmt.Pos()} },
+			func() { list[i] = stmt })
+	}
+}
+
+/*
+ Implements -mutate: builds the tests of the package, then builds and runs
+ them again for every mutation of its non-test files and reports the
+ mutants that survived, i.e. didn't make any test fail. Mutants that don't
+ compile are skipped, mutants whose tests time out count as killed.
+*/
+func mutationTest() {
+	pack, exists := goPackages.Get(*flagMutate)
+	if !exists || pack.Type != godata.LOCAL_PACKAGE {
+		testLog.Error("No local package %s found.\n", *flagMutate)
+		os.Exit(1)
+	}
+	if _, hasExtPack := goPackages.GetExternalTestPackage(pack.Name); !pack.HasTestFiles() && !hasExtPack {
+		testLog.Error("Package %s has no tests.\n", pack.Name)
+		os.Exit(1)
+	}
+
+	testPack := createTestPackage(map[*godata.GoPackage]bool{pack: true})
+	if !compile(testPack) || !link(testPack) {
+		testLog.Error("Can't run mutation tests because of build errors.\n")
+		os.Exit(1)
+	}
+
+	argv := []string{outputDirPrefix + testPack.OutputFile}
+	if *flagMatch != "" {
+		argv = append(argv, "-match", *flagMatch)
+	}
+
+	// the tests have to pass without mutations, their duration is used for
+	// the timeout of the mutants
+	start := time.Nanoseconds()
+	_, packageTimeout := getTimeouts()
+	if passed, _ := runMutantTests(argv, packageTimeout); !passed {
+		testLog.Error("The tests of %s fail without mutations, run gobuild -t -run for details.\n", pack.Name)
+		os.Exit(1)
+	}
+	timeout := packageTimeout
+	if timeout == 0 {
+		timeout = 10 * (time.Nanoseconds() - start)
+		if timeout < MUTANT_MIN_TIMEOUT {
+			timeout = MUTANT_MIN_TIMEOUT
+		}
+	}
+
+	mutations, files := findMutations(pack)
+	testLog.Info("Testing %d mutants of %s...\n", len(mutations), pack.Name)
+
+	var killed, invalid int
+	var survived []*mutation
+	for i, m := range mutations {
+		testLog.Debug("Mutant %d/%d: %s:%d: %s\n", i+1, len(mutations), m.pos.Filename, m.pos.Line, m.description)
+
+		m.apply()
+		mutantFile := getObjDir() + "mutate/" + m.file.Filename
+		writeGeneratedFile(mutantFile, printMutant(files[m.file], m.pos.Filename))
+		m.revert()
+		replacedFiles[m.file.Filename] = mutantFile
+
+		if !buildMutant(pack, testPack) {
+			invalid++
+		} else if passed, timedOut := runMutantTests(argv, timeout); passed {
+			survived = append(survived, m)
+		} else {
+			if timedOut {
+				testLog.Debug("Tests of mutant %d timed out.\n", i+1)
+			}
+			killed++
+		}
+
+		replacedFiles[m.file.Filename] = "", false
+	}
+
+	// leave the original package in the object directory
+	buildMutant(pack, testPack)
+
+	testLog.Info("%d mutants: %d killed, %d survived, %d didn't compile.\n",
+		len(mutations), killed, len(survived), invalid)
+	if killed+len(survived) > 0 {
+		testLog.Info("Mutation score: %.1f%%\n", 100*float64(killed)/float64(killed+len(survived)))
+	}
+	if len(survived) > 0 {
+		testLog.Warn("Surviving mutants:\n")
+		for _, m := range survived {
+			testLog.WarnContinue("%s:%d: %s\n", m.pos.Filename, m.pos.Line, m.description)
+		}
+	}
+}
+
+/*
+ Parses all non-test files of a package and returns their mutations and
+ ASTs.
+*/
+func findMutations(pack *godata.GoPackage) (mutations []*mutation, files map[*godata.GoFile]*mutantFile) {
+	files = make(map[*godata.GoFile]*mutantFile)
+	for _, gf := range pack.GetSourceFiles(false) {
+		visitor := &mutationVisitor{file: gf, fset: token.NewFileSet()}
+		fileast, err := parser.ParseFile(visitor.fset, gf.Filename, nil, 0)
+		if err != nil {
+			testLog.Error("%s\n", err)
+			os.Exit(1)
+		}
+		ast.Walk(visitor, fileast)
+
+		files[gf] = &mutantFile{visitor.fset, fileast}
+		mutations = append(mutations, visitor.mutations...)
+	}
+	return
+}
+
+// the parsed source of a file
+type mutantFile struct {
+	fset    *token.FileSet
+	fileast *ast.File
+}
+
+func printMutant(file *mutantFile, filename string) []byte {
+	var buf bytes.Buffer
+	if _, err := printer.Fprint(&buf, file.fset, file.fileast); err != nil {
+		testLog.Error("Could not write mutant of %s: %s\n", filename, err)
+		os.Exit(1)
+	}
+	return buf.Bytes()
+}
+
+/*
+ Compiles the package and everything that depends on it again and links the
+ test executable. The output of the compiler and linker isn't shown because
+ many mutants don't compile. Returns false if there were errors.
+*/
+func buildMutant(pack, testPack *godata.GoPackage) bool {
+	for _, packName := range goPackages.GetPackageNames() {
+		p, _ := goPackages.Get(packName)
+		if p == pack || dependsOn(p, pack, make(map[*godata.GoPackage]bool)) {
+			p.Compiled = false
+			p.HasErrors = false
+		}
+	}
+	testPack.Compiled = false
+	testPack.HasErrors = false
+
+	quietBuild = true
+	logger.SetVerbosityLevel(logger.ERROR)
+	success := compile(testPack) && link(testPack)
+	setVerbosityLevel()
+	quietBuild = false
+
+	return success
+}
+
+/*
+ Returns true if pack depends on target, directly or indirectly.
+*/
+func dependsOn(pack, target *godata.GoPackage, visited map[*godata.GoPackage]bool) bool {
+	if visited[pack] {
+		return false
+	}
+	visited[pack] = true
+
+	for _, idep := range *pack.Depends {
+		dep := idep.(*godata.GoPackage)
+		if dep == target || dependsOn(dep, target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Runs the test executable without showing its output. The tests are killed
+ if they run longer than timeout ns (0 = no timeout). Returns true if all
+ tests passed.
+*/
+func runMutantTests(argv []string, timeout int64) (passed bool, timedOut bool) {
+	cmd, err := exec.Run(argv[0], argv, os.Environ(), rootPath,
+		exec.DevNull, exec.DevNull, exec.DevNull)
+	if err != nil {
+		testLog.Error("%s\n", err)
+		os.Exit(1)
+	}
+
+	done := make(chan bool)
+	go func() {
+		waitmsg, err := cmd.Wait(0)
+		done <- err == nil && waitmsg.ExitStatus() == 0
+	}()
+
+	var timer <-chan int64
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case passed = <-done:
+	case <-timer:
+		syscall.Kill(cmd.Pid, syscall.SIGKILL)
+		<-done
+		timedOut = true
+	}
+	return
+}
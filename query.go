@@ -0,0 +1,321 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Queries over the package graph (-query), e.g. "deps(cmd/server) - stdlib"
+ or "tests(rdeps(util))".
+
+ Grammar:
+	expr = term { ("+" | "-" | "&") term }
+	term = name | "all" | "stdlib" | func "(" expr ")" | "(" expr ")"
+	func = "deps" | "rdeps" | "files" | "tests"
+
+ A "-" inside a name (third-party/foo) is part of the name, it's only the
+ difference if it starts a token, e.g. after a space or a parenthesis.
+*/
+package main
+
+import (
+	"os"
+	"strings"
+	"./godata"
+	"./logger"
+)
+
+// result of a query: a set of packages or (files != nil) a set of files
+type queryValue struct {
+	packs map[*godata.GoPackage]bool
+	files map[string]bool
+}
+
+func newPackageValue() *queryValue {
+	return &queryValue{make(map[*godata.GoPackage]bool), nil}
+}
+
+func newFileValue() *queryValue {
+	return &queryValue{nil, make(map[string]bool)}
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+/*
+ Splits a query into names, operators and parentheses.
+*/
+func tokenizeQuery(query string) (tokens []string) {
+	var name string
+	for _, rune := range query {
+		if rune == '-' && name != "" {
+			name += string(rune)
+		} else if strings.IndexRune("()+-&", rune) >= 0 || rune == ' ' || rune == '\t' || rune == '\n' {
+			if name != "" {
+				tokens = append(tokens, name)
+				name = ""
+			}
+			if rune != ' ' && rune != '\t' && rune != '\n' {
+				tokens = append(tokens, string(rune))
+			}
+		} else {
+			name += string(rune)
+		}
+	}
+	if name != "" {
+		tokens = append(tokens, name)
+	}
+	return
+}
+
+func newQueryParser(query string) *queryParser {
+	return &queryParser{tokens: tokenizeQuery(query)}
+}
+
+func (this *queryParser) peek() string {
+	if this.pos < len(this.tokens) {
+		return this.tokens[this.pos]
+	}
+	return ""
+}
+
+func (this *queryParser) next() string {
+	token := this.peek()
+	this.pos++
+	return token
+}
+
+func (this *queryParser) expect(token string) os.Error {
+	if found := this.next(); found != token {
+		return os.NewError("expected " + token + " instead of " + quoteToken(found))
+	}
+	return nil
+}
+
+func quoteToken(token string) string {
+	if token == "" {
+		return "end of query"
+	}
+	return "\"" + token + "\""
+}
+
+/*
+ Parses and evaluates the whole query.
+*/
+func (this *queryParser) parse() (*queryValue, os.Error) {
+	value, err := this.parseExpr()
+	if err == nil && this.peek() != "" {
+		err = os.NewError("unexpected " + quoteToken(this.peek()))
+	}
+	return value, err
+}
+
+func (this *queryParser) parseExpr() (*queryValue, os.Error) {
+	value, err := this.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := this.peek(); op == "+" || op == "-" || op == "&"; op = this.peek() {
+		this.next()
+		right, err := this.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if (value.files == nil) != (right.files == nil) {
+			return nil, os.NewError("can't combine packages and files with " + op)
+		}
+		value = combineQueryValues(value, right, op)
+	}
+	return value, nil
+}
+
+func (this *queryParser) parseTerm() (*queryValue, os.Error) {
+	token := this.next()
+	switch token {
+	case "(":
+		value, err := this.parseExpr()
+		if err == nil {
+			err = this.expect(")")
+		}
+		return value, err
+	case "", ")", "+", "-", "&":
+		return nil, os.NewError("unexpected " + quoteToken(token))
+	}
+
+	if this.peek() != "(" {
+		return this.getNamed(token)
+	}
+
+	this.next()
+	arg, err := this.parseExpr()
+	if err == nil {
+		err = this.expect(")")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if arg.files != nil {
+		return nil, os.NewError(token + "() needs packages, not files")
+	}
+
+	switch token {
+	case "deps", "rdeps":
+		value := newPackageValue()
+		for pack, _ := range arg.packs {
+			value.packs[pack] = true
+			related := goPackages.Dependencies(pack, true)
+			if token == "rdeps" {
+				related = goPackages.Dependents(pack, true)
+			}
+			for _, relatedPack := range related {
+				value.packs[relatedPack] = true
+			}
+		}
+		return value, nil
+	case "files":
+		value := newFileValue()
+		for pack, _ := range arg.packs {
+			for _, igf := range *pack.Files {
+				value.files[igf.(*godata.GoFile).Filename] = true
+			}
+		}
+		return value, nil
+	case "tests":
+		// _test.go files are only read with -t
+		if !*flagTesting {
+			return nil, os.NewError("tests() needs -t")
+		}
+		// including the files of external test packages
+		value := newFileValue()
+		for pack, _ := range arg.packs {
+			for _, testFilePack := range getTestFilePackages(pack) {
+				for _, igf := range *testFilePack.Files {
+					if gf := igf.(*godata.GoFile); gf.IsTestFile {
+						value.files[gf.Filename] = true
+					}
+				}
+			}
+		}
+		return value, nil
+	}
+	return nil, os.NewError("unknown function " + token)
+}
+
+/*
+ Returns the packages for a name: all packages, all packages that aren't
+ part of the tree (stdlib), a package or a main file (with or without
+ ".go", packages come first). A main file comes with the other files of the
+ main package unless -single-main is used.
+*/
+func (this *queryParser) getNamed(name string) (*queryValue, os.Error) {
+	value := newPackageValue()
+	switch name {
+	case "all":
+		for _, pack := range goPackages.GetPackages() {
+			value.packs[pack] = true
+		}
+	case "stdlib":
+		for _, pack := range goPackages.GetPackages() {
+			if pack.Files.Len() == 0 {
+				value.packs[pack] = true
+			}
+		}
+	default:
+		if pack, exists := goPackages.Get(name); exists && name != "main" {
+			value.packs[pack] = true
+			break
+		}
+		pack, exists := goPackages.GetMain(name, false)
+		if !exists && !strings.HasSuffix(name, ".go") {
+			pack, exists = goPackages.GetMain(name+".go", false)
+		}
+		if !exists {
+			if pack, exists = goPackages.Get(name); !exists {
+				return nil, os.NewError("unknown package " + name)
+			}
+		}
+		value.packs[pack] = true
+		if mainPack, exists := goPackages.Get("main"); exists && pack != mainPack && !*flagSingleMainFile {
+			value.packs[mainPack] = true
+		}
+	}
+	return value, nil
+}
+
+/*
+ Returns the union (+), difference (-) or intersection (&) of two values of
+ the same kind.
+*/
+func combineQueryValues(left, right *queryValue, op string) *queryValue {
+	if left.files != nil {
+		value := newFileValue()
+		for filename, _ := range left.files {
+			if op != "&" || right.files[filename] {
+				value.files[filename] = true
+			}
+		}
+		for filename, _ := range right.files {
+			if op == "+" {
+				value.files[filename] = true
+			} else if op == "-" {
+				value.files[filename] = false, false
+			}
+		}
+		return value
+	}
+
+	value := newPackageValue()
+	for pack, _ := range left.packs {
+		if op != "&" || right.packs[pack] {
+			value.packs[pack] = true
+		}
+	}
+	for pack, _ := range right.packs {
+		if op == "+" {
+			value.packs[pack] = true
+		} else if op == "-" {
+			value.packs[pack] = false, false
+		}
+	}
+	return value
+}
+
+/*
+ Returns the name a package is printed with: the main file for main
+ packages, the package name otherwise.
+*/
+func getQueryName(pack *godata.GoPackage) string {
+	if pack.Name == "main" {
+		for _, igf := range *pack.Files {
+			if gf := igf.(*godata.GoFile); gf.HasMain {
+				return gf.Filename
+			}
+		}
+	}
+	return pack.Name
+}
+
+/*
+ Evaluates the -query expression and prints the resulting packages or
+ files, sorted and one per line. Returns false if the query is invalid.
+*/
+func runQuery(query string) bool {
+	value, err := newQueryParser(query).parse()
+	if err != nil {
+		logger.Error("Invalid query: %s\n", err)
+		return false
+	}
+
+	names := value.files
+	if names == nil {
+		names = make(map[string]bool)
+		for pack, _ := range value.packs {
+			names[getQueryName(pack)] = true
+		}
+	}
+	for _, name := range getSortedKeys(names) {
+		logger.Print("%s\n", name)
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Rerunning failed tests (-retry) and reporting flaky tests.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// names of all tests and examples in _testmain (package.TestXxx)
+var testFunctionNames []string
+
+/*
+ Returns the tests that have to be run again after a test run: all tests of
+ pending that failed or didn't run at all. testing.Main exits after the
+ first package with a failed test, so the tests of all following packages
+ never ran.
+*/
+func getRetryTests(report *TestReport, pending []string) (retry []string) {
+	results := make(map[string]*TestResult)
+	for _, pack := range report.Packages {
+		for _, test := range pack.Tests {
+			results[test.Name] = test
+		}
+	}
+
+	for _, name := range pending {
+		if test, exists := results[name]; !exists || test.Status == STATUS_FAIL {
+			retry = append(retry, name)
+		}
+	}
+	return
+}
+
+/*
+ Returns all tests that are run by the first test run, i.e. all tests in
+ _testmain that match -match.
+*/
+func getMatchingTests() (names []string) {
+	for _, name := range testFunctionNames {
+		if *flagMatch != "" {
+			if matched, _ := regexp.MatchString(*flagMatch, name); !matched {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+/*
+ Creates a -match regular expression that matches exactly the given tests.
+*/
+func getRetryMatch(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteRegexp(name)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+/*
+ Escapes all characters that have a special meaning in regular expressions.
+*/
+func quoteRegexp(str string) string {
+	var buf bytes.Buffer
+	for _, rune := range str {
+		if strings.IndexRune(`\.+*?()|[]{}^$`, rune) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(rune)
+	}
+	return buf.String()
+}
+
+/*
+ Adds the results of a retry to the report of the first run. Tests that
+ failed before and passed now are marked as flaky.
+*/
+func mergeTestReports(report, retry *TestReport) {
+	for _, retryPack := range retry.Packages {
+		var pack *PackageResult
+		for _, p := range report.Packages {
+			if p.Name == retryPack.Name {
+				pack = p
+				break
+			}
+		}
+		if pack == nil {
+			report.Packages = append(report.Packages, retryPack)
+			continue
+		}
+
+		for _, retryTest := range retryPack.Tests {
+			test := pack.GetTest(retryTest.Name)
+			if test == nil {
+				pack.Tests = append(pack.Tests, retryTest)
+				continue
+			}
+			if test.Status == STATUS_FAIL && retryTest.Status == STATUS_PASS {
+				test.Flaky = true
+			}
+			test.Attempts++
+			test.Status = retryTest.Status
+			test.Duration = retryTest.Duration
+			test.Output += retryTest.Output
+		}
+
+		pack.Duration += retryPack.Duration
+		pack.Output += retryPack.Output
+		if pack.Status == STATUS_FAIL || retryPack.Status == STATUS_FAIL {
+			pack.Status = retryPack.Status
+		}
+	}
+	report.Benchmarks = append(report.Benchmarks, retry.Benchmarks...)
+}
+
+/*
+ Returns all tests that failed at first but passed on a retry.
+*/
+func getFlakyTests(report *TestReport) (flaky []*TestResult) {
+	for _, pack := range report.Packages {
+		for _, test := range pack.Tests {
+			if test.Flaky {
+				flaky = append(flaky, test)
+			}
+		}
+	}
+	return
+}
+
+/*
+ Prints the flaky tests of a run and writes them to -flaky-report, one test
+ per line with the number of the run it passed in.
+*/
+func reportFlakyTests(report *TestReport) {
+	flaky := getFlakyTests(report)
+	if len(flaky) > 0 {
+		testLog.Warn("%d flaky test(s), passed after a retry:\n", len(flaky))
+		for _, test := range flaky {
+			testLog.WarnContinue("%s (run %d)\n", test.Name, test.Attempts)
+		}
+	}
+
+	if *flagFlakyReport != "" {
+		var buf bytes.Buffer
+		for _, test := range flaky {
+			fmt.Fprintf(&buf, "%s %d\n", test.Name, test.Attempts)
+		}
+		if err := ioutil.WriteFile(*flagFlakyReport, buf.Bytes(), 0644); err != nil {
+			testLog.Error("Could not write %s: %s\n", *flagFlakyReport, err)
+		}
+	}
+}
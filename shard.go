@@ -0,0 +1,138 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Splitting the tests into shards that can be run on different machines.
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"json"
+	"sort"
+)
+
+/*
+ Parses -shard i/n. Returns (0, 0) if sharding is disabled. Shards are
+ numbered from 1 to n.
+*/
+func getShard() (index, count int) {
+	if *flagShard == "" {
+		return 0, 0
+	}
+
+	n, err := fmt.Sscanf(*flagShard, "%d/%d", &index, &count)
+	if n != 2 || err != nil || count < 1 || index < 1 || index > count {
+		testLog.Error("Invalid -shard %s, expected i/n with 1 <= i <= n.\n", *flagShard)
+		os.Exit(1)
+	}
+	return
+}
+
+/*
+ Returns the names of the tests (package.TestXxx) that belong to the shard
+ selected with -shard. Without -shard-durations a test belongs to the shard
+ given by the hash of its name, so adding a test never moves other tests.
+ With the durations of an earlier run (-json report) the tests are spread
+ so that every shard needs about the same time: the longest test goes to the
+ shard with the least work so far. Tests without a recorded duration count
+ with the average duration.
+*/
+func selectShardTests(names []string) map[string]bool {
+	index, count := getShard()
+	selected := make(map[string]bool)
+
+	var durations map[string]float64
+	if *flagShardDurations != "" {
+		durations = loadTestDurations(*flagShardDurations)
+	}
+
+	if len(durations) == 0 {
+		for _, name := range names {
+			if int(crc32.ChecksumIEEE([]byte(name))%uint32(count)) == index-1 {
+				selected[name] = true
+			}
+		}
+		return selected
+	}
+
+	var total float64
+	for _, duration := range durations {
+		total += duration
+	}
+	average := total / float64(len(durations))
+
+	tests := make(shardTestList, len(names))
+	for i, name := range names {
+		duration, exists := durations[name]
+		if !exists {
+			duration = average
+		}
+		tests[i] = shardTest{name, duration}
+	}
+	sort.Sort(tests)
+
+	load := make([]float64, count)
+	for _, test := range tests {
+		shard := 0
+		for i := 1; i < count; i++ {
+			if load[i] < load[shard] {
+				shard = i
+			}
+		}
+		load[shard] += test.duration
+		if shard == index-1 {
+			selected[test.name] = true
+		}
+	}
+	return selected
+}
+
+/*
+ Reads the durations of all tests from a JSON report written by -json.
+*/
+func loadTestDurations(filename string) map[string]float64 {
+	durations := make(map[string]float64)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		testLog.Warn("Could not read test durations, sharding by name: %s\n", err)
+		return durations
+	}
+	report := new(TestReport)
+	if err = json.Unmarshal(data, report); err != nil {
+		testLog.Warn("Could not read test durations, sharding by name: %s\n", err)
+		return durations
+	}
+
+	for _, pack := range report.Packages {
+		for _, test := range pack.Tests {
+			durations[test.Name] = test.Duration
+		}
+	}
+	return durations
+}
+
+// a test and how long it takes
+type shardTest struct {
+	name     string
+	duration float64
+}
+
+// sorts tests by duration (longest first), tests with the same duration by name
+type shardTestList []shardTest
+
+func (this shardTestList) Len() int { return len(this) }
+
+func (this shardTestList) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+
+func (this shardTestList) Less(i, j int) bool {
+	if this[i].duration != this[j].duration {
+		return this[i].duration > this[j].duration
+	}
+	return this[i].name < this[j].name
+}
@@ -0,0 +1,223 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Caching the results of packages whose tests passed, so that they aren't
+ run again as long as nothing they depend on changed.
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"crypto/sha1"
+	"hash"
+	"io/ioutil"
+	"json"
+	"strings"
+	"./godata"
+	"./logger"
+	"./testevent"
+)
+
+// packages whose tests are in _testmain, set by createTestPackage
+var testedPackages []*godata.GoPackage
+
+// environment variable with the packages _testmain doesn't run (see skipCheckSource)
+const TEST_SKIP_ENV = "GOBUILD_SKIP"
+
+// a cached package result and the key it is valid for
+type testCacheEntry struct {
+	Key    string
+	Result *PackageResult
+}
+
+/*
+ Returns true if test results may be taken from the cache. Coverage needs
+ the counters of all packages, so -cover always runs everything. With -fuzz
+ no tests are run at all.
+*/
+func useTestCache() bool {
+	return !*flagNoTestCache && !*flagCover && *flagFuzz == ""
+}
+
+func getTestCacheFilename(pack *godata.GoPackage) string {
+	return getObjDir() + "cache/" + strings.Replace(pack.Name, "/", "_", -1) + ".json"
+}
+
+/*
+ Returns the cache key of a tested package: a hash of the options passed to
+ _testmain, the selected shard, the source files of the package (including the external test
+ package), the corpus of its fuzz functions and the object files of all
+ local packages it depends on. Has to be called after compiling.
+*/
+func getTestCacheKey(pack *godata.GoPackage, argv []string) string {
+	h := sha1.New()
+	h.Write([]byte(strings.Join(argv[1:], "\x00") + "\n"))
+	h.Write([]byte(*flagShard + "\n"))
+
+	visited := make(map[*godata.GoPackage]bool)
+	var hashDepends func(*godata.GoPackage)
+	hashDepends = func(p *godata.GoPackage) {
+		for _, idep := range *p.Depends {
+			dep := idep.(*godata.GoPackage)
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if dep.Compiled {
+				hashFile(h, getObjDir()+dep.OutputFile+objExt)
+			}
+			hashDepends(dep)
+		}
+	}
+
+	for _, tpack := range getTestFilePackages(pack) {
+		for _, gf := range tpack.GetSourceFiles(true) {
+			hashFile(h, gf.Filename)
+			// the corpus is run as a test, -fuzz adds crashing inputs to it
+			if gf.IsTestFile {
+				for _, istr := range *gf.FuzzFunctions {
+					hashDir(h, getFuzzCorpusDir(gf, istr.(string)))
+				}
+			}
+		}
+		hashDepends(tpack)
+	}
+
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+/*
+ Returns the cache keys of all tested packages by package name.
+*/
+func getTestCacheKeys(argv []string) map[string]string {
+	keys := make(map[string]string)
+	for _, pack := range testedPackages {
+		keys[pack.Name] = getTestCacheKey(pack, argv)
+	}
+	return keys
+}
+
+func hashFile(h hash.Hash, filename string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		// a missing file changes the key as well
+		data = []byte(err.String())
+	}
+	fmt.Fprintf(h, "%s %d\n", filename, len(data))
+	h.Write(data)
+}
+
+/*
+ Hashes all files of a directory (not its subdirectories), sorted by name.
+*/
+func hashDir(h hash.Hash, dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(h, "%s %s\n", dir, err)
+		return
+	}
+	for _, info := range infos {
+		if info.IsRegular() {
+			hashFile(h, dir+"/"+info.Name)
+		}
+	}
+}
+
+/*
+ Prints the results of all packages that passed before with the same key
+ (and sends their events for -test-events) and sets TEST_SKIP_ENV so that
+ _testmain doesn't run them again. Returns the replayed results.
+*/
+func replayCachedTests(keys map[string]string) (cached []*PackageResult) {
+	var skip []string
+
+	if useTestCache() {
+		for _, pack := range testedPackages {
+			data, err := ioutil.ReadFile(getTestCacheFilename(pack))
+			if err != nil {
+				continue
+			}
+			entry := new(testCacheEntry)
+			if err = json.Unmarshal(data, entry); err != nil || entry.Result == nil {
+				testLog.Debug("Ignoring invalid test cache entry for %s.\n", pack.Name)
+				continue
+			}
+			if entry.Key != keys[pack.Name] || entry.Result.Status != STATUS_PASS {
+				continue
+			}
+
+			entry.Result.Cached = true
+			cached = append(cached, entry.Result)
+			skip = append(skip, pack.Name)
+
+			testLog.Info("Testing %s: (cached)\n", pack.Name)
+			converter := testevent.NewConverter(writeTestEvent)
+			converter.Line("Testing " + pack.Name + ":\n")
+			task := logger.NewTask(pack.Name)
+			for _, line := range strings.SplitAfter(entry.Result.Output, "\n", -1) {
+				if line != "" {
+					showTestLine(task, line)
+					converter.Line(line)
+				}
+			}
+			task.Close()
+			converter.Close()
+		}
+	}
+
+	if err := os.Setenv(TEST_SKIP_ENV, strings.Join(skip, " ")); err != nil {
+		testLog.Error("%s\n", err)
+		os.Exit(1)
+	}
+	return
+}
+
+/*
+ Stores the results of all packages that passed and weren't taken from the
+ cache. If _testmain failed (exitStatus) but no package did, it's unknown
+ which package the failure belongs to and nothing is stored.
+*/
+func saveTestCache(report *TestReport, keys map[string]string, exitStatus int) {
+	if exitStatus != 0 {
+		explained := false
+		for _, p := range report.Packages {
+			if p.Status == STATUS_FAIL {
+				explained = true
+				break
+			}
+		}
+		if !explained {
+			testLog.Debug("Not caching test results, _testmain failed outside of a package.\n")
+			return
+		}
+	}
+
+	for _, pack := range testedPackages {
+		var result *PackageResult
+		for _, p := range report.Packages {
+			if p.Name == pack.Name {
+				result = p
+				break
+			}
+		}
+		if result == nil || result.Cached || result.Status != STATUS_PASS {
+			continue
+		}
+
+		data, err := json.Marshal(&testCacheEntry{keys[pack.Name], result})
+		if err != nil {
+			testLog.Warn("Could not cache test results of %s: %s\n", pack.Name, err)
+			continue
+		}
+		filename := getTestCacheFilename(pack)
+		if err = os.MkdirAll(filename[0:strings.LastIndex(filename, "/")], rootPathPerm); err == nil {
+			err = ioutil.WriteFile(filename, data, 0644)
+		}
+		if err != nil {
+			testLog.Warn("Could not cache test results of %s: %s\n", pack.Name, err)
+		}
+	}
+}
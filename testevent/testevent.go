@@ -0,0 +1,230 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Converts the output of a gobuild _testmain executable into a stream of
+ events. Every package starts with a "Testing <pkg>:" line and ends with
+ PASS or FAIL, benchmark results follow "Benchmarking <pkg>:" lines. Tests
+ are found by the "=== RUN" and "--- PASS/FAIL/SKIP" lines, so _testmain
+ has to be run with -v to get the events of passed tests.
+*/
+package testevent
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// actions of an event
+const (
+	START  = "start"  // a package starts (Test is empty)
+	RUN    = "run"    // a test starts
+	PASS   = "pass"   // a test passed, or all tests of a package if Test is empty
+	FAIL   = "fail"   // a test failed, or a package if Test is empty
+	SKIP   = "skip"   // a test was skipped
+	OUTPUT = "output" // a line of output
+	BENCH  = "bench"  // a line with a benchmark result (Test is the benchmark)
+)
+
+/*
+ A single event. Output lines that belong to a test (everything it logs)
+ have its name in Test, lines like "=== RUN" or "PASS" have no test.
+*/
+type Event struct {
+	Time    string  // RFC 3339
+	Action  string  // one of the constants above
+	Package string  // empty for output outside of a package
+	Test    string  // full name as printed by _testmain (package.TestXxx)
+	Elapsed float64 // in seconds, only for PASS, FAIL and SKIP
+	Output  string  // the line including the trailing newline, only for OUTPUT and BENCH
+}
+
+/*
+ Turns lines of _testmain output into events. Implements io.Writer, so the
+ output can be copied into it, incomplete lines are kept until the rest
+ arrives.
+*/
+type Converter struct {
+	handler      func(*Event)
+	pack         string   // current package, "" outside of tests
+	test         string   // test that gets the current output lines
+	running      []string // tests without result in the current package
+	packStart    int64    // start time of the current package in ns
+	benchmarking bool     // true = after a "Benchmarking <pkg>:" line
+	buf          []byte   // incomplete line passed to Write
+}
+
+/*
+ Creates a new converter that calls handler for every event.
+*/
+func NewConverter(handler func(*Event)) *Converter {
+	return &Converter{handler: handler}
+}
+
+/*
+ Implementation of io.Writer.
+*/
+func (this *Converter) Write(data []byte) (n int, err os.Error) {
+	this.buf = append(this.buf, data...)
+	for {
+		idx := bytes.IndexByte(this.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		this.Line(string(this.buf[0 : idx+1]))
+		this.buf = this.buf[idx+1:]
+	}
+	return len(data), nil
+}
+
+/*
+ Converts the last incomplete line and finishes the current package. A
+ package or test without result didn't finish (crash or os.Exit) and fails.
+*/
+func (this *Converter) Close() os.Error {
+	if len(this.buf) > 0 {
+		this.Line(string(this.buf))
+		this.buf = nil
+	}
+	this.endPackage(FAIL)
+	return nil
+}
+
+/*
+ Returns the test that is currently running, or "" if there is none.
+*/
+func (this *Converter) RunningTest() string {
+	if len(this.running) == 0 {
+		return ""
+	}
+	return this.running[len(this.running)-1]
+}
+
+/*
+ Converts a single line of output (including the trailing newline).
+*/
+func (this *Converter) Line(line string) {
+	trimmed := strings.TrimRight(line, "\r\n")
+
+	if name := getHeaderName(trimmed, "Testing "); name != "" {
+		this.endPackage(FAIL)
+		this.benchmarking = false
+		this.emit(&Event{Action: OUTPUT, Package: name, Output: line})
+		this.pack = name
+		this.packStart = time.Nanoseconds()
+		this.emit(&Event{Action: START, Package: name})
+		return
+	}
+	if name := getHeaderName(trimmed, "Benchmarking "); name != "" {
+		this.endPackage(FAIL)
+		this.benchmarking = true
+		this.pack = name
+		this.emit(&Event{Action: OUTPUT, Package: name, Output: line})
+		return
+	}
+
+	if this.benchmarking {
+		action := OUTPUT
+		fields := strings.Fields(trimmed)
+		if len(fields) >= 4 && strings.Index(fields[0], "Benchmark") >= 0 &&
+			strings.Index(trimmed, "ns/op") >= 0 {
+			action = BENCH
+			this.test = fields[0]
+		}
+		this.emit(&Event{Action: action, Package: this.pack, Test: this.test, Output: line})
+		this.test = ""
+		return
+	}
+
+	if this.pack == "" {
+		this.emit(&Event{Action: OUTPUT, Output: line})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(trimmed, "=== RUN "):
+		this.emit(&Event{Action: OUTPUT, Package: this.pack, Output: line})
+		this.test = strings.TrimSpace(trimmed[len("=== RUN "):])
+		this.running = append(this.running, this.test)
+		this.emit(&Event{Action: RUN, Package: this.pack, Test: this.test})
+	case strings.HasPrefix(trimmed, "--- PASS: "):
+		this.endTest(line, trimmed[len("--- PASS: "):], PASS)
+	case strings.HasPrefix(trimmed, "--- FAIL: "):
+		this.endTest(line, trimmed[len("--- FAIL: "):], FAIL)
+	case strings.HasPrefix(trimmed, "--- SKIP: "):
+		this.endTest(line, trimmed[len("--- SKIP: "):], SKIP)
+	case trimmed == "PASS" || trimmed == "FAIL":
+		this.emit(&Event{Action: OUTPUT, Package: this.pack, Output: line})
+		this.endPackage(strings.ToLower(trimmed))
+	default:
+		this.emit(&Event{Action: OUTPUT, Package: this.pack, Test: this.test, Output: line})
+	}
+}
+
+/*
+ Sends the result of a test from a "--- STATUS: name (x.xx seconds)" line.
+ The test stays the current one because its log is printed afterwards.
+*/
+func (this *Converter) endTest(line, result, action string) {
+	var name string = result
+	var elapsed float64
+
+	if idx := strings.Index(result, " ("); idx >= 0 {
+		name = result[0:idx]
+		fields := strings.Fields(result[idx+2:])
+		if len(fields) > 0 {
+			elapsed, _ = strconv.Atof64(fields[0])
+		}
+	}
+
+	for i, test := range this.running {
+		if test == name {
+			this.running = append(this.running[0:i], this.running[i+1:]...)
+			break
+		}
+	}
+
+	this.test = name
+	this.emit(&Event{Action: OUTPUT, Package: this.pack, Output: line})
+	this.emit(&Event{Action: action, Package: this.pack, Test: name, Elapsed: elapsed})
+}
+
+/*
+ Finishes the current package with the given action (PASS or FAIL). Tests
+ that are still running failed.
+*/
+func (this *Converter) endPackage(action string) {
+	if this.pack == "" {
+		return
+	}
+	if !this.benchmarking {
+		for _, test := range this.running {
+			this.emit(&Event{Action: FAIL, Package: this.pack, Test: test})
+		}
+		elapsed := float64(time.Nanoseconds()-this.packStart) / 1e9
+		this.emit(&Event{Action: action, Package: this.pack, Elapsed: elapsed})
+	}
+	this.pack = ""
+	this.test = ""
+	this.running = nil
+}
+
+func (this *Converter) emit(event *Event) {
+	event.Time = time.UTC().Format(time.RFC3339)
+	this.handler(event)
+}
+
+/*
+ Returns the package name of a "<prefix><pkg>:" line, or "" if the line
+ doesn't have this form.
+*/
+func getHeaderName(line, prefix string) string {
+	if strings.HasPrefix(line, prefix) && strings.HasSuffix(line, ":") {
+		return line[len(prefix) : len(line)-1]
+	}
+	return ""
+}
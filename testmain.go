@@ -0,0 +1,306 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Source code that is added to the generated _testmain.go file.
+*/
+package main
+
+// imports needed by exampleRunnerSource
+var exampleRunnerImports = []string{"bytes", "flag", "fmt", "io", "os", "strings", "time"}
+
+/*
+ Runs Example* functions and compares what they print to stdout with the
+ text of their "// Output:" comment. Uses the -match and -v flags of the
+ testing package and prints the same --- FAIL/--- PASS lines as tests do.
+ __examplesFailed__ is called before exiting on failure if it's set.
+*/
+const exampleRunnerSource = `
+type __example__ struct {
+	name   string
+	f      func()
+	output string
+}
+
+var __examplesFailed__ func()
+
+func __runExamples__(examples []__example__, printPass bool) {
+	var pattern string
+	var chatty bool
+
+	flag.Parse()
+	if f := flag.Lookup("match"); f != nil {
+		pattern = f.Value.String()
+	}
+	if f := flag.Lookup("v"); f != nil {
+		chatty = f.Value.String() == "true"
+	}
+
+	ok := true
+	for _, eg := range examples {
+		if pattern != "" {
+			if matched, _ := __regexp__.MatchString(pattern, eg.name); !matched {
+				continue
+			}
+		}
+		if chatty {
+			fmt.Println("=== RUN ", eg.name)
+		}
+
+		// redirect stdout into a pipe while the example is running
+		stdout := os.Stdout
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout = w
+		outC := make(chan string)
+		go func() {
+			var buf bytes.Buffer
+			io.Copy(&buf, r)
+			r.Close()
+			outC <- buf.String()
+		}()
+
+		ns := -time.Nanoseconds()
+		eg.f()
+		ns += time.Nanoseconds()
+
+		w.Close()
+		os.Stdout = stdout
+		out := strings.TrimSpace(<-outC)
+
+		tstr := fmt.Sprintf("(%.2f seconds)", float64(ns)/1e9)
+		if out != eg.output {
+			fmt.Printf("--- FAIL: %s %s\ngot:\n%s\nwant:\n%s\n", eg.name, tstr, out, eg.output)
+			ok = false
+		} else if chatty {
+			fmt.Printf("--- PASS: %s %s\n", eg.name, tstr)
+		}
+	}
+
+	if !ok {
+		fmt.Println("FAIL")
+		if __examplesFailed__ != nil {
+			__examplesFailed__()
+		}
+		os.Exit(1)
+	}
+	if printPass {
+		fmt.Println("PASS")
+	}
+}
+`
+
+// imports needed by skipCheckSource
+var skipCheckImports = []string{"os", "strings"}
+
+/*
+ Checks if the tests of a package are skipped because gobuild replays their
+ cached result (see TEST_SKIP_ENV).
+*/
+const skipCheckSource = `
+func __skip__(pack string) bool {
+	for _, name := range strings.Fields(os.Getenv("GOBUILD_SKIP")) {
+		if name == pack {
+			return true
+		}
+	}
+	return false
+}
+`
+
+// imports needed by coverWriterSource
+var coverWriterImports = []string{"fmt", "os"}
+
+/*
+ Writes the counters of all packages instrumented for -cover into the
+ profile __coverProfile__. Every line has the package name, the statement
+ block (see coverBlock) and how often the block was executed.
+
+ testing.Main exits if a test failed, so the profile is also written when
+ it asks __coverMatch__ if the last test of a package (__coverLastTest__)
+ matches -match: all other tests ran by then. The last test itself never
+ runs.
+*/
+const coverWriterSource = `
+type __cover__ struct {
+	pack   string
+	blocks []string
+	counts []uint32
+}
+
+const __coverLastTest__ = "__gobuild_cover__"
+
+func __coverMatch__(pattern, name string) (bool, os.Error) {
+	if name == __coverLastTest__ {
+		__writeCoverProfile__()
+		return false, nil
+	}
+	return __regexp__.MatchString(pattern, name)
+}
+
+func __writeCoverProfile__() {
+	f, err := os.Create(__coverProfile__)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create coverage profile: %s\n", err)
+		os.Exit(1)
+	}
+	for _, c := range __coverage__ {
+		for i, block := range c.blocks {
+			fmt.Fprintf(f, "%s %s %d\n", c.pack, block, c.counts[i])
+		}
+	}
+	f.Close()
+}
+`
+
+// imports needed by fuzzRunnerSource
+var fuzzRunnerImports = []string{"crypto/sha1", "flag", "fmt", "io/ioutil", "os", "path", "rand", "time"}
+
+/*
+ Runs Fuzz* functions. Without -fuzz the files of the corpus directory are
+ run as a regular test. With -fuzz the matching fuzz function is called
+ with random mutations of the corpus for -fuzztime ns, the first input that
+ makes it panic is saved in the corpus directory.
+*/
+const fuzzRunnerSource = `
+type __fuzzTarget__ struct {
+	name   string
+	f      func([]byte)
+	corpus string
+}
+
+var __fuzzPattern__ = flag.String("fuzz", "", "run the fuzz function matching this regular expression")
+var __fuzzTime__ = flag.Int64("fuzztime", 30e9, "time to spend fuzzing in ns")
+
+/*
+ Calls a fuzz function and returns the message of a panic, or "".
+*/
+func __fuzzCall__(f func([]byte), data []byte) (msg string) {
+	defer func() {
+		if err := recover(); err != nil {
+			msg = fmt.Sprint("panic: ", err)
+		}
+	}()
+	f(data)
+	return
+}
+
+func __readFuzzCorpus__(dir string) (names []string, corpus [][]byte, err os.Error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, fi := range files {
+		if !fi.IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name))
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, fi.Name)
+		corpus = append(corpus, data)
+	}
+	return
+}
+
+func __runFuzzCorpus__(t *testing.T, dir string, f func([]byte)) {
+	names, corpus, err := __readFuzzCorpus__(dir)
+	if err != nil {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			t.Error(err)
+		}
+		return
+	}
+	for i, data := range corpus {
+		if msg := __fuzzCall__(f, data); msg != "" {
+			t.Errorf("%s: %s", path.Join(dir, names[i]), msg)
+		}
+	}
+}
+
+/*
+ Changes 1-4 random bytes of a copy of data: flips a bit, replaces, inserts
+ or deletes a byte or appends a part of another corpus entry.
+*/
+func __mutate__(data []byte, corpus [][]byte) []byte {
+	data = append([]byte(nil), data...)
+	for n := rand.Intn(4); n >= 0; n-- {
+		switch op := rand.Intn(5); {
+		case op == 0 && len(data) > 0:
+			data[rand.Intn(len(data))] ^= 1 << uint(rand.Intn(8))
+		case op == 1 && len(data) > 0:
+			data[rand.Intn(len(data))] = byte(rand.Intn(256))
+		case op == 2 && len(data) > 0:
+			i := rand.Intn(len(data))
+			data = append(data[0:i], data[i+1:]...)
+		case op == 3:
+			other := corpus[rand.Intn(len(corpus))]
+			if len(other) > 0 {
+				i := rand.Intn(len(other))
+				data = append(data, other[i:i+1+rand.Intn(len(other)-i)]...)
+			}
+		default:
+			i := rand.Intn(len(data) + 1)
+			data = append(data[0:i], append([]byte{byte(rand.Intn(256))}, data[i:]...)...)
+		}
+	}
+	return data
+}
+
+func __fuzz__(targets []__fuzzTarget__) {
+	flag.Parse()
+	if *__fuzzPattern__ == "" {
+		return
+	}
+
+	var target *__fuzzTarget__
+	for i := range targets {
+		if matched, _ := __regexp__.MatchString(*__fuzzPattern__, targets[i].name); matched {
+			if target != nil {
+				fmt.Fprintf(os.Stderr, "-fuzz %s matches %s and %s, only one fuzz function can be run\n",
+					*__fuzzPattern__, target.name, targets[i].name)
+				os.Exit(1)
+			}
+			target = &targets[i]
+		}
+	}
+	if target == nil {
+		fmt.Fprintf(os.Stderr, "-fuzz %s matches no fuzz function\n", *__fuzzPattern__)
+		os.Exit(1)
+	}
+
+	_, corpus, _ := __readFuzzCorpus__(target.corpus)
+	if len(corpus) == 0 {
+		corpus = [][]byte{[]byte{}}
+	}
+
+	fmt.Printf("Fuzzing %s (%d corpus entries):\n", target.name, len(corpus))
+	rand.Seed(time.Nanoseconds())
+	start := time.Nanoseconds()
+	var count int
+	for ; time.Nanoseconds()-start < *__fuzzTime__; count++ {
+		data := __mutate__(corpus[rand.Intn(len(corpus))], corpus)
+		if msg := __fuzzCall__(target.f, data); msg != "" {
+			hash := sha1.New()
+			hash.Write(data)
+			filename := path.Join(target.corpus, fmt.Sprintf("crash-%x", hash.Sum()))
+			os.MkdirAll(target.corpus, 0755)
+			if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not save crashing input: %s\n", err)
+			}
+			fmt.Printf("--- FAIL: %s (after %d inputs)\n\t%s\n\tinput saved as %s\n",
+				target.name, count+1, msg, filename)
+			fmt.Println("FAIL")
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("%d inputs in %.1f seconds, no crash\n", count, float64(time.Nanoseconds()-start)/1e9)
+	fmt.Println("PASS")
+	os.Exit(0)
+}
+`
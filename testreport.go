@@ -0,0 +1,556 @@
+// Copyright 2009-2010 by Maurice Gilden. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+ Test reports (JUnit XML and JSON) created from the output of _testmain.
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"bytes"
+	"exec"
+	"io"
+	"json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"./logger"
+	"./testevent"
+)
+
+// status of a test or package
+const (
+	STATUS_PASS = testevent.PASS
+	STATUS_FAIL = testevent.FAIL
+	STATUS_SKIP = testevent.SKIP
+)
+
+// exit status of gobuild if a test run was killed because of -timeout
+const EXIT_TIMEOUT = 124
+
+// time between SIGQUIT and SIGKILL for hanging tests, in ns
+const TIMEOUT_GRACE_PERIOD = 5e9
+
+// ========== test results ==========
+
+// result of a single Test* (or Example*) function
+type TestResult struct {
+	Name     string  // full name as printed by _testmain (package.TestXxx)
+	Status   string  // STATUS_PASS, STATUS_FAIL or STATUS_SKIP
+	Duration float64 // in seconds
+	Output   string  // everything the test printed
+	Attempts int     // number of runs, more than 1 with -retry
+	Flaky    bool    // true = failed at first but passed on a retry
+}
+
+// results of all tests of a package, one for every "Testing <pkg>:" header
+type PackageResult struct {
+	Name     string  // name of the package
+	Status   string  // STATUS_PASS or STATUS_FAIL
+	Duration float64 // in seconds
+	Output   string  // complete output of the package
+	Cached   bool    // true = result of an earlier run (see testcache.go)
+	Tests    []*TestResult
+}
+
+// results of a complete run of _testmain
+type TestReport struct {
+	Packages   []*PackageResult
+	Benchmarks []*BenchmarkResult
+}
+
+/*
+ Returns the number of tests with the given status.
+*/
+func (this *PackageResult) Count(status string) (count int) {
+	for _, test := range this.Tests {
+		if test.Status == status {
+			count++
+		}
+	}
+	return
+}
+
+/*
+ Returns the test with the given name, or nil if there is none.
+*/
+func (this *PackageResult) GetTest(name string) *TestResult {
+	for _, test := range this.Tests {
+		if test.Name == name {
+			return test
+		}
+	}
+	return nil
+}
+
+// ========== testOutputParser ==========
+
+/*
+ Creates a TestReport from the events of the output of _testmain (see
+ package testevent).
+*/
+type testOutputParser struct {
+	report    *TestReport
+	pack      *PackageResult // current package, nil outside of tests
+	test      *TestResult    // test that gets the current output lines
+	converter *testevent.Converter
+}
+
+func newTestOutputParser() *testOutputParser {
+	parser := &testOutputParser{report: new(TestReport)}
+	parser.converter = testevent.NewConverter(func(event *testevent.Event) {
+		writeTestEvent(event)
+		parser.handleEvent(event)
+	})
+	return parser
+}
+
+/*
+ Parses a single line of output (including the trailing newline).
+*/
+func (this *testOutputParser) parseLine(line string) {
+	this.converter.Line(line)
+}
+
+func (this *testOutputParser) handleEvent(event *testevent.Event) {
+	switch event.Action {
+	case testevent.START:
+		this.pack = &PackageResult{Name: event.Package}
+		this.test = nil
+		this.report.Packages = append(this.report.Packages, this.pack)
+	case testevent.BENCH:
+		if result := parseBenchmarkLine(event.Output); result != nil {
+			this.report.Benchmarks = append(this.report.Benchmarks, result)
+		}
+	}
+
+	if this.pack == nil {
+		return
+	}
+
+	switch event.Action {
+	case testevent.OUTPUT:
+		this.pack.Output += event.Output
+		if event.Test != "" && this.test != nil {
+			this.test.Output += event.Output
+		}
+	case testevent.RUN:
+		this.test = &TestResult{Name: event.Test, Attempts: 1}
+		this.pack.Tests = append(this.pack.Tests, this.test)
+	case testevent.PASS, testevent.FAIL, testevent.SKIP:
+		if event.Test == "" {
+			this.pack.Status = event.Action
+			this.pack.Duration = event.Elapsed
+			this.pack = nil
+			this.test = nil
+			break
+		}
+		this.test = this.pack.GetTest(event.Test)
+		if this.test == nil {
+			this.test = &TestResult{Name: event.Test, Attempts: 1}
+			this.pack.Tests = append(this.pack.Tests, this.test)
+		}
+		this.test.Status = event.Action
+		this.test.Duration = event.Elapsed
+	}
+}
+
+/*
+ Returns the report after all output was parsed.
+*/
+func (this *testOutputParser) finish() *TestReport {
+	this.converter.Close()
+	return this.report
+}
+
+// ========== test events ==========
+
+// file for -test-events, opened with the first event
+var testEventsFile *os.File
+
+/*
+ Writes an event as a line of JSON to the file given by -test-events.
+*/
+func writeTestEvent(event *testevent.Event) {
+	if *flagTestEvents == "" {
+		return
+	}
+	if testEventsFile == nil {
+		if *flagTestEvents == "-" {
+			testEventsFile = os.Stdout
+		} else {
+			var err os.Error
+			if testEventsFile, err = os.Create(*flagTestEvents); err != nil {
+				testLog.Error("Could not create %s: %s\n", *flagTestEvents, err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		testLog.Error("Could not write test event: %s\n", err)
+		return
+	}
+	testEventsFile.Write(append(data, '\n'))
+}
+
+// ========== running tests ==========
+
+/*
+ Returns true if the output of the test executable has to be parsed.
+*/
+func needsTestReport() bool {
+	return *flagJUnitReport != "" || *flagJSONReport != ""
+}
+
+/*
+ Returns true if _testmain has to be run with -v, the reports need the
+ --- PASS lines, the timeouts need the === RUN lines to know which test
+ is currently running, -retry needs both to know which tests ran and
+ -test-events needs them for the run/pass events.
+*/
+func needsVerboseTestOutput() bool {
+	return needsTestReport() || *flagTimeout != "" || *flagPackageTimeout != "" ||
+		*flagRetry > 0 || *flagTestEvents != ""
+}
+
+/*
+ Returns the package name of a "Testing <pkg>:" or "Benchmarking <pkg>:"
+ line, or "" if the line is none of them.
+*/
+func getSectionName(line string) string {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasSuffix(line, ":") {
+		return ""
+	}
+	for _, prefix := range []string{"Testing ", "Benchmarking "} {
+		if strings.HasPrefix(line, prefix) {
+			return line[len(prefix) : len(line)-1]
+		}
+	}
+	return ""
+}
+
+/*
+ Runs the test executable and parses its output while passing it on to
+ stdout (see showTestLine). The output of every package is a task of its own
+ (see logger.Task), so -output applies to it.
+ If -timeout or -package-timeout is exceeded, the test executable gets a
+ SIGQUIT (to print the stack traces of all goroutines) and is killed after
+ a grace period. The exit status is EXIT_TIMEOUT in this case.
+ Returns the parsed report and the exit status of the test executable.
+*/
+func runTestExec(argv []string) (report *TestReport, exitStatus int) {
+	var runTimeout, packageTimeout int64 = getTimeouts()
+	var ticker *time.Ticker
+	var tick <-chan int64
+	var sectionName string
+	var runStart, sectionStart int64
+	var task *logger.Task
+
+	parser := newTestOutputParser()
+
+	printCommand(argv, rootPath)
+	testLog.Info("Executing %s:\n", argv[0])
+	testLog.Debug("%s\n", getCommandline(argv))
+	cmd, err := exec.Run(argv[0], argv, os.Environ(), rootPath,
+		exec.PassThrough, exec.Pipe, exec.MergeWithStdout)
+	if err != nil {
+		testLog.Error("%s\n", err)
+		os.Exit(1)
+	}
+
+	lines := readLines(cmd.Stdout)
+	handleLine := func(line string) {
+		if name := getSectionName(line); name != "" {
+			if task != nil {
+				task.Close()
+			}
+			task = logger.NewTask(name)
+			sectionName = name
+			sectionStart = time.Nanoseconds()
+		}
+		if task == nil {
+			task = logger.NewTask(argv[0])
+		}
+		parser.parseLine(line)
+		showTestLine(task, line)
+	}
+
+	// the timeouts are checked once a second
+	if runTimeout > 0 || packageTimeout > 0 {
+		ticker = time.NewTicker(1e9)
+		tick = ticker.C
+		defer ticker.Stop()
+	}
+	runStart = time.Nanoseconds()
+	sectionStart = runStart
+
+	for running := true; running; {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				running = false
+				break
+			}
+			handleLine(line)
+		case now := <-tick:
+			var elapsed int64
+			if runTimeout > 0 && now-runStart > runTimeout {
+				elapsed = now - runStart
+			} else if packageTimeout > 0 && sectionName != "" && now-sectionStart > packageTimeout {
+				elapsed = now - sectionStart
+			} else {
+				break
+			}
+
+			runningTest := parser.converter.RunningTest()
+			if runningTest == "" {
+				runningTest = "none"
+			}
+			testLog.Error("Test timeout after %.1fs in package %s, running test: %s.\n",
+				float64(elapsed)/1e9, sectionName, runningTest)
+			killTestExec(cmd, lines, handleLine)
+			exitStatus = EXIT_TIMEOUT
+			running = false
+		}
+	}
+
+	if task != nil {
+		task.Close()
+	}
+
+	waitmsg, err := cmd.Wait(0)
+	if err != nil {
+		testLog.Error("Executing %s failed: %s.\n", argv[0], err)
+		os.Exit(1)
+	}
+	if exitStatus == 0 {
+		exitStatus = waitmsg.ExitStatus()
+	}
+
+	return parser.finish(), exitStatus
+}
+
+/*
+ Passes a line of test output on to a writer, usually the task of the
+ package. Lines that are only there because -v was added for the report are
+ not shown unless gobuild itself runs in verbose mode.
+*/
+func showTestLine(writer io.Writer, line string) {
+	if *flagVerboseMode || !(strings.HasPrefix(line, "=== RUN ") ||
+		strings.HasPrefix(line, "--- PASS: ")) {
+		io.WriteString(writer, line)
+	}
+}
+
+/*
+ Reads lines from a file in the background. The channel is closed at the
+ end of the file.
+*/
+func readLines(file *os.File) <-chan string {
+	lines := make(chan string)
+	go func() {
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				lines <- line
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(lines)
+	}()
+	return lines
+}
+
+/*
+ Sends SIGQUIT to a hanging test executable so that the Go runtime prints
+ the stack traces of all goroutines, then kills it if it's still running
+ after TIMEOUT_GRACE_PERIOD. The remaining output is passed to handleLine.
+*/
+func killTestExec(cmd *exec.Cmd, lines <-chan string, handleLine func(string)) {
+	syscall.Kill(cmd.Pid, syscall.SIGQUIT)
+
+	grace := time.After(TIMEOUT_GRACE_PERIOD)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			handleLine(line)
+		case <-grace:
+			syscall.Kill(cmd.Pid, syscall.SIGKILL)
+			for line := range lines {
+				handleLine(line)
+			}
+			return
+		}
+	}
+}
+
+/*
+ Writes the reports selected with -junit and -json.
+*/
+func writeTestReports(report *TestReport) {
+	if *flagJUnitReport != "" {
+		writeReportFile(*flagJUnitReport, createJUnitReport(report))
+	}
+	if *flagJSONReport != "" {
+		data, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			testLog.Error("Could not create JSON report: %s\n", err)
+			return
+		}
+		writeReportFile(*flagJSONReport, append(data, '\n'))
+	}
+}
+
+func writeReportFile(filename string, data []byte) {
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		testLog.Error("Could not write report %s: %s\n", filename, err)
+		return
+	}
+	testLog.Info("Test report written to %s.\n", filename)
+}
+
+// ========== timeouts ==========
+
+/*
+ Returns the -timeout and -package-timeout values in ns, 0 if not set.
+*/
+func getTimeouts() (runTimeout, packageTimeout int64) {
+	var err os.Error
+	if *flagTimeout != "" {
+		if runTimeout, err = parseDuration(*flagTimeout); err != nil {
+			testLog.Error("Invalid -timeout: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagPackageTimeout != "" {
+		if packageTimeout, err = parseDuration(*flagPackageTimeout); err != nil {
+			testLog.Error("Invalid -package-timeout: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	return
+}
+
+/*
+ Parses a duration like "90", "90s", "1.5m", "2h" or "500ms" and returns it
+ in ns. A number without unit is in seconds.
+*/
+func parseDuration(str string) (int64, os.Error) {
+	units := []struct {
+		suffix string
+		ns     float64
+	}{
+		{"ms", 1e6},
+		{"s", 1e9},
+		{"m", 60e9},
+		{"h", 3600e9},
+	}
+
+	var factor float64 = 1e9
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = str[0 : len(str)-len(unit.suffix)]
+			factor = unit.ns
+			break
+		}
+	}
+
+	value, err := strconv.Atof64(str)
+	if err != nil || value < 0 {
+		return 0, os.NewError("invalid duration " + str)
+	}
+	return int64(value * factor), nil
+}
+
+// ========== JUnit XML ==========
+
+/*
+ Creates a JUnit XML report with one testsuite per package.
+*/
+func createJUnitReport(report *TestReport) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	buf.WriteString("<testsuites>\n")
+	for _, pack := range report.Packages {
+		// a failed package without failed tests crashed or exited early
+		var errors int
+		if pack.Status == STATUS_FAIL && pack.Count(STATUS_FAIL) == 0 {
+			errors = 1
+		}
+
+		fmt.Fprintf(&buf, "\t<testsuite name=\"%s\" tests=\"%d\" failures=\"%d\" errors=\"%d\" skipped=\"%d\" time=\"%.3f\">\n",
+			xmlEscape(pack.Name), len(pack.Tests)+errors, pack.Count(STATUS_FAIL), errors,
+			pack.Count(STATUS_SKIP), pack.Duration)
+
+		for _, test := range pack.Tests {
+			fmt.Fprintf(&buf, "\t\t<testcase classname=\"%s\" name=\"%s\" time=\"%.3f\">\n",
+				xmlEscape(pack.Name), xmlEscape(test.Name), test.Duration)
+			switch {
+			case test.Status == STATUS_FAIL:
+				fmt.Fprintf(&buf, "\t\t\t<failure message=\"Failed\">%s</failure>\n", xmlEscape(test.Output))
+			case test.Status == STATUS_SKIP:
+				buf.WriteString("\t\t\t<skipped/>\n")
+			case test.Flaky:
+				fmt.Fprintf(&buf, "\t\t\t<flakyFailure message=\"Passed on run %d\"/>\n", test.Attempts)
+			}
+			if test.Output != "" {
+				fmt.Fprintf(&buf, "\t\t\t<system-out>%s</system-out>\n", xmlEscape(test.Output))
+			}
+			buf.WriteString("\t\t</testcase>\n")
+		}
+
+		// errors are only allowed inside a testcase
+		if errors > 0 {
+			fmt.Fprintf(&buf, "\t\t<testcase classname=\"%s\" name=\"(package)\" time=\"0.000\">\n",
+				xmlEscape(pack.Name))
+			buf.WriteString("\t\t\t<error message=\"package did not finish\"/>\n")
+			buf.WriteString("\t\t</testcase>\n")
+		}
+		fmt.Fprintf(&buf, "\t\t<system-out>%s</system-out>\n", xmlEscape(pack.Output))
+		buf.WriteString("\t</testsuite>\n")
+	}
+	buf.WriteString("</testsuites>\n")
+
+	return buf.Bytes()
+}
+
+/*
+ Escapes a string for XML attributes and character data. Control characters
+ that are not allowed in XML are dropped.
+*/
+func xmlEscape(str string) string {
+	var buf bytes.Buffer
+	for _, rune := range str {
+		switch {
+		case rune == '&':
+			buf.WriteString("&amp;")
+		case rune == '<':
+			buf.WriteString("&lt;")
+		case rune == '>':
+			buf.WriteString("&gt;")
+		case rune == '"':
+			buf.WriteString("&quot;")
+		case rune < 0x20 && rune != '\t' && rune != '\n' && rune != '\r':
+			// not allowed in XML 1.0
+		default:
+			buf.WriteRune(rune)
+		}
+	}
+	return buf.String()
+}